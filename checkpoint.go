@@ -0,0 +1,364 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	// checkpointCommentPrefix starts the comment set on checkpoint databases
+	checkpointCommentPrefix = "sql_sandbox: checkpoint"
+	// checkpointNamePrefix follows the test database prefix in checkpoint database names
+	checkpointNamePrefix = "checkpoint_"
+)
+
+// checkpointRegistry remembers the checkpoint databases by name until they are dropped
+type checkpointRegistry struct {
+	mu          sync.Mutex
+	checkpoints map[string]*checkpoint
+}
+
+// checkpoint is a database holding the state of a sandbox at the time of Checkpoint,
+// cloned like a template
+type checkpoint struct {
+	dbName string
+	config *Config
+	// sandbox is the sandbox the checkpoint was taken of, the only one that may replace it
+	sandbox *Sandbox
+}
+
+// checkpoints remembers the checkpoints of sandboxes created without a Manager
+var checkpoints checkpointRegistry
+
+// get returns the checkpoint registered under name
+func (r *checkpointRegistry) get(name string) (*checkpoint, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ckpt, ok := r.checkpoints[name]
+	return ckpt, ok
+}
+
+// put registers the checkpoint under name and returns the one it replaces, if any.
+// Checkpoints of other sandboxes are not replaced, e.g. of parallel tests.
+func (r *checkpointRegistry) put(name string, ckpt *checkpoint) (*checkpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.checkpoints[name]
+	if err := previous.checkOwner(name, ckpt.sandbox); err != nil {
+		return nil, err
+	}
+	if r.checkpoints == nil {
+		r.checkpoints = make(map[string]*checkpoint)
+	}
+	r.checkpoints[name] = ckpt
+	return previous, nil
+}
+
+// checkOwner returns an error if the checkpoint exists and was taken of another sandbox
+func (c *checkpoint) checkOwner(name string, s *Sandbox) error {
+	if c != nil && c.sandbox != s {
+		return fmt.Errorf("checkpoint %q already exists for another sandbox", name)
+	}
+	return nil
+}
+
+// remove removes the checkpoint registered under name if it was not replaced since,
+// reporting whether it did
+func (r *checkpointRegistry) remove(name string, ckpt *checkpoint) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.checkpoints[name] != ckpt {
+		return false
+	}
+	delete(r.checkpoints, name)
+	return true
+}
+
+// takeAll removes all checkpoints from the registry and returns them
+func (r *checkpointRegistry) takeAll() []*checkpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]*checkpoint, 0, len(r.checkpoints))
+	for _, ckpt := range r.checkpoints {
+		all = append(all, ckpt)
+	}
+	r.checkpoints = nil
+	return all
+}
+
+// Checkpoint saves the current state of the sandbox database under name, so that
+// Restore and NewFromCheckpoint can start from it instead of the template, e.g. after
+// expensive seeding shared by several tests. The database is cloned like a template,
+// which requires disconnecting it: idle connections are closed, connections still in
+// use and pgx connections are terminated, and the pools of the sandbox reconnect on
+// their next use. A checkpoint of the same name taken of the same sandbox is replaced,
+// one taken of another sandbox is an error. Checkpoints are dropped
+// when the Manager or Pool of the sandbox is closed. Checkpoints of sandboxes created
+// without one are dropped when the test of NewT completes, or else by DropCheckpoints.
+// It requires IsolationDatabase.
+func (s *Sandbox) Checkpoint(ctx context.Context, name string) error {
+	if name == "" {
+		return fmt.Errorf("checkpoint name must not be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkCloneSupport("checkpoints"); err != nil {
+		return err
+	}
+	registry := s.checkpointRegistry()
+	if previous, _ := registry.get(name); previous != nil {
+		if err := previous.checkOwner(name, s); err != nil {
+			return err
+		}
+	}
+
+	adminDB, limiter, release, err := s.ddlConn()
+	if err != nil {
+		return fmt.Errorf("failed to connect to admin DB to checkpoint test DB: %w", err)
+	}
+	defer release()
+
+	ckpt := &checkpoint{
+		dbName:  generateTestDBName(s.Config.TestDBPrefix, checkpointNamePrefix+name),
+		config:  s.Config,
+		sandbox: s,
+	}
+
+	reconnect := s.drain()
+	defer reconnect()
+	if err := terminateConnections(ctx, adminDB, s.DBName); err != nil {
+		log.Printf("Warning: failed to terminate connections to test database: %v", err)
+	}
+	if err := cloneDatabaseFrom(ctx, adminDB, limiter, s.Config, s.DBName, ckpt.dbName); err != nil {
+		return fmt.Errorf("failed to create checkpoint %q: %w", name, err)
+	}
+	if err := commentOnDatabase(ctx, adminDB, ckpt.dbName, checkpointCommentPrefix+" "+name); err != nil {
+		log.Printf("Warning: failed to comment checkpoint database: %v", err)
+	}
+
+	// Another sandbox may have registered the name while the database was cloned
+	previous, err := registry.put(name, ckpt)
+	if err != nil {
+		if dropErr := limiter.dropDatabase(context.Background(), adminDB, ckpt.dbName); dropErr != nil {
+			log.Printf("Warning: failed to drop unregistered checkpoint database: %v", dropErr)
+		}
+		return err
+	}
+	if s.owner() == nil && s.testCleanup != nil {
+		s.testCleanup(func() {
+			if registry.remove(name, ckpt) {
+				if err := dropCheckpoint(context.Background(), ckpt); err != nil {
+					log.Printf("Warning: failed to drop checkpoint %q: %v", name, err)
+				}
+			}
+		})
+	}
+	if previous != nil {
+		if err := limiter.dropDatabase(ctx, adminDB, previous.dbName); err != nil {
+			return fmt.Errorf("failed to drop replaced checkpoint %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Restore resets the sandbox database to the state saved by Checkpoint. The database
+// is dropped and cloned from the checkpoint under the same name, so DB and the other
+// pools of the sandbox stay valid and reconnect on their next use. Connections in use
+// are terminated like with Checkpoint.
+func (s *Sandbox) Restore(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkCloneSupport("checkpoints"); err != nil {
+		return err
+	}
+	ckpt, ok := s.checkpointRegistry().get(name)
+	if !ok {
+		return fmt.Errorf("checkpoint %q does not exist", name)
+	}
+
+	if err := s.recreate(ctx, ckpt.dbName); err != nil {
+		return fmt.Errorf("failed to restore checkpoint %q: %w", name, err)
+	}
+	return nil
+}
+
+// NewFromCheckpoint creates a new sandbox from the state saved by Checkpoint on a
+// sandbox of the manager
+func (m *Manager) NewFromCheckpoint(ctx context.Context, name string) (*Sandbox, error) {
+	if m.closed.Load() {
+		return nil, fmt.Errorf("manager is closed")
+	}
+	ckpt, ok := m.checkpoints.get(name)
+	if !ok {
+		return nil, fmt.Errorf("checkpoint %q does not exist", name)
+	}
+
+	sandbox, err := m.newDatabaseSandbox(ctx, ckpt.dbName, "")
+	if err != nil {
+		return nil, err
+	}
+	sandbox.manager = m
+	return sandbox, nil
+}
+
+// NewFromCheckpoint creates a new sandbox from the state saved by Checkpoint on a
+// sandbox created without a Manager, with the configuration of that sandbox
+func NewFromCheckpoint(ctx context.Context, name string) (*Sandbox, error) {
+	ckpt, ok := checkpoints.get(name)
+	if !ok {
+		return nil, fmt.Errorf("checkpoint %q does not exist", name)
+	}
+
+	m, err := openManager(ctx, ckpt.config, nil, &setupMap, &sharedDBMap)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	return m.newDatabaseSandbox(ctx, ckpt.dbName, "")
+}
+
+// DropCheckpoints drops the checkpoints of sandboxes created without a Manager, e.g.
+// at the end of TestMain. Checkpoints of a Manager or Pool are dropped by its Close.
+func DropCheckpoints(ctx context.Context) error {
+	var errs []error
+	for _, ckpt := range checkpoints.takeAll() {
+		if err := dropCheckpoint(ctx, ckpt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dropCheckpoint drops the database of a checkpoint created without a Manager
+func dropCheckpoint(ctx context.Context, ckpt *checkpoint) error {
+	adminDB, err := openAdminDB(ctx, ckpt.config)
+	if err != nil {
+		return err
+	}
+	defer adminDB.Close()
+	return newDDLLimiter(ckpt.config).dropDatabase(ctx, adminDB, ckpt.dbName)
+}
+
+// dropCheckpoints drops the checkpoints of the manager
+func (m *Manager) dropCheckpoints(ctx context.Context) error {
+	var errors []string
+	for _, ckpt := range m.checkpoints.takeAll() {
+		if err := m.limiter.dropDatabase(ctx, m.adminDB, ckpt.dbName); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("failed to drop checkpoints: %s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// checkCloneSupport reports why the sandbox database cannot be cloned for what, e.g.
+// checkpoints
+func (s *Sandbox) checkCloneSupport(what string) error {
+	switch {
+	case s.closed || s.DBName == "":
+		return fmt.Errorf("sandbox is closed")
+	case !s.ownsDatabase():
+		return fmt.Errorf("%s require IsolationDatabase", what)
+	case s.Role != "":
+		// Objects owned by the sandbox role would keep it from being dropped
+		return fmt.Errorf("%s are not supported with sandbox roles", what)
+	}
+	return nil
+}
+
+// checkpointRegistry returns the registry of the manager the sandbox was created by
+func (s *Sandbox) checkpointRegistry() *checkpointRegistry {
+	if m := s.owner(); m != nil {
+		return m.checkpoints
+	}
+	return &checkpoints
+}
+
+// owner returns the manager of the sandbox, directly or through its pool
+func (s *Sandbox) owner() *Manager {
+	if s.pool != nil {
+		return s.pool.manager
+	}
+	return s.manager
+}
+
+// ddlConn returns the admin connection pool and limiter to create and drop databases
+// for the sandbox with, and a function releasing them
+func (s *Sandbox) ddlConn() (*sql.DB, *ddlLimiter, func(), error) {
+	if m := s.owner(); m != nil {
+		return m.adminDB, m.limiter, func() {}, nil
+	}
+
+	adminDB, release, err := s.adminConn()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return adminDB, newDDLLimiter(s.Config), release, nil
+}
+
+// drain closes the idle connections of all pools of the sandbox, so that its database
+// can be cloned or dropped once the connections in use are terminated. It returns a
+// function letting the pools keep idle connections again. The pgx pool is reset and
+// pgx connections are closed, since they would be terminated anyway.
+func (s *Sandbox) drain() func() {
+	pools := append([]*sql.DB{s.TestDB}, s.sessionDBs...)
+	if s.roleDB != nil {
+		pools = append(pools, s.roleDB)
+	}
+	for _, db := range pools {
+		db.SetMaxIdleConns(0)
+	}
+
+	if s.pgxPool != nil {
+		s.pgxPool.Reset()
+	}
+	for _, conn := range s.pgxConns {
+		conn.Close(context.Background())
+	}
+	s.pgxConns = nil
+
+	return func() {
+		for _, db := range pools {
+			// The database/sql default
+			db.SetMaxIdleConns(2)
+		}
+	}
+}
+
+// recreate drops the sandbox database and clones it anew from templateDBName under the
+// same name, keeping the pools of the sandbox
+func (s *Sandbox) recreate(ctx context.Context, templateDBName string) error {
+	adminDB, limiter, release, err := s.ddlConn()
+	if err != nil {
+		return fmt.Errorf("failed to connect to admin DB to recreate test DB: %w", err)
+	}
+	defer release()
+
+	reconnect := s.drain()
+	defer reconnect()
+	if err := limiter.dropDatabase(ctx, adminDB, s.DBName); err != nil {
+		return err
+	}
+	if err := cloneDatabaseFrom(ctx, adminDB, limiter, s.Config, templateDBName, s.DBName); err != nil {
+		return err
+	}
+	if s.Role != "" {
+		return grantSandboxRole(ctx, adminDB, s.Config.Role, s.DBName)
+	}
+	return nil
+}
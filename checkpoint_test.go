@@ -0,0 +1,250 @@
+package sql_sandbox
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointRegistry(t *testing.T) {
+	var r checkpointRegistry
+
+	_, ok := r.get("seeded")
+	assert.False(t, ok)
+
+	first := &checkpoint{dbName: "test_db_checkpoint_seeded_1"}
+	previous, err := r.put("seeded", first)
+	require.NoError(t, err)
+	assert.Nil(t, previous)
+	ckpt, ok := r.get("seeded")
+	require.True(t, ok)
+	assert.Same(t, first, ckpt)
+
+	second := &checkpoint{dbName: "test_db_checkpoint_seeded_2"}
+	previous, err = r.put("seeded", second)
+	require.NoError(t, err)
+	assert.Same(t, first, previous)
+	other := &checkpoint{dbName: "test_db_checkpoint_other_3"}
+	_, err = r.put("other", other)
+	require.NoError(t, err)
+
+	// A checkpoint is only removed while it is still registered
+	assert.False(t, r.remove("seeded", first))
+	assert.True(t, r.remove("other", other))
+	assert.False(t, r.remove("other", other))
+	_, err = r.put("other", other)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []*checkpoint{second, other}, r.takeAll())
+	_, ok = r.get("seeded")
+	assert.False(t, ok)
+	assert.Empty(t, r.takeAll())
+}
+
+func TestCheckpointRegistryOwner(t *testing.T) {
+	var r checkpointRegistry
+	mine, theirs := &Sandbox{}, &Sandbox{}
+
+	_, err := r.put("seeded", &checkpoint{dbName: "test_db_checkpoint_seeded_1", sandbox: mine})
+	require.NoError(t, err)
+
+	// Another sandbox, e.g. of a parallel test, does not replace the checkpoint
+	_, err = r.put("seeded", &checkpoint{dbName: "test_db_checkpoint_seeded_2", sandbox: theirs})
+	assert.ErrorContains(t, err, `checkpoint "seeded" already exists for another sandbox`)
+	ckpt, ok := r.get("seeded")
+	require.True(t, ok)
+	assert.Equal(t, "test_db_checkpoint_seeded_1", ckpt.dbName)
+
+	previous, err := r.put("seeded", &checkpoint{dbName: "test_db_checkpoint_seeded_3", sandbox: mine})
+	require.NoError(t, err)
+	assert.Same(t, ckpt, previous)
+}
+
+func TestCheckCloneSupport(t *testing.T) {
+	assert.NoError(t, (&Sandbox{DBName: "test_db"}).checkCloneSupport("checkpoints"))
+	assert.ErrorContains(t, (&Sandbox{DBName: "main", Schema: "test_schema"}).checkCloneSupport("checkpoints"), "IsolationDatabase")
+	assert.ErrorContains(t, (&Sandbox{DBName: "shared", tx: &txConnector{}}).checkCloneSupport("checkpoints"), "IsolationDatabase")
+	assert.ErrorContains(t, (&Sandbox{DBName: "test_db", Role: "test_db"}).checkCloneSupport("checkpoints"), "sandbox roles")
+	assert.ErrorContains(t, (&Sandbox{}).checkCloneSupport("checkpoints"), "closed")
+	assert.ErrorContains(t, (&Sandbox{DBName: "test_db", closed: true}).checkCloneSupport("checkpoints"), "closed")
+	assert.ErrorContains(t, (&Sandbox{DBName: "main", Schema: "test_schema", closed: true}).checkCloneSupport("checkpoints"), "closed")
+	assert.ErrorContains(t, (&Sandbox{DBName: "main", Config: &Config{Isolation: IsolationSchema}}).checkCloneSupport("checkpoints"), "IsolationDatabase")
+}
+
+func TestCheckpointErrors(t *testing.T) {
+	ctx := context.Background()
+	sandbox := &Sandbox{DBName: "test_db", Config: DefaultConfig()}
+
+	assert.ErrorContains(t, sandbox.Checkpoint(ctx, ""), "must not be empty")
+	assert.ErrorContains(t, sandbox.Restore(ctx, "missing"), `checkpoint "missing" does not exist`)
+
+	_, err := NewFromCheckpoint(ctx, "missing")
+	assert.ErrorContains(t, err, `checkpoint "missing" does not exist`)
+}
+
+func TestCheckpoint(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_ckpt_"
+
+	m, err := NewManager(ctx, getTestDBURL(), config)
+	require.NoError(t, err)
+
+	count := func(s *Sandbox) int {
+		var n int
+		require.NoError(t, s.DB().QueryRowContext(ctx, "SELECT count(*) FROM ckpt_items").Scan(&n))
+		return n
+	}
+
+	sandbox, err := m.New(ctx)
+	require.NoError(t, err)
+	defer sandbox.Close()
+
+	_, err = sandbox.DB().ExecContext(ctx, "CREATE TABLE ckpt_items (id int)")
+	require.NoError(t, err)
+	_, err = sandbox.DB().ExecContext(ctx, "INSERT INTO ckpt_items SELECT generate_series(1, 3)")
+	require.NoError(t, err)
+
+	// An open pgx pool and session pool do not keep the database from being cloned
+	_, err = sandbox.PgxPool(ctx)
+	require.NoError(t, err)
+	_, err = sandbox.As(ctx, "", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, sandbox.Checkpoint(ctx, "seeded"))
+
+	// The pools of the sandbox keep working after the checkpoint
+	_, err = sandbox.DB().ExecContext(ctx, "DELETE FROM ckpt_items")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count(sandbox))
+
+	dbName := sandbox.DBName
+	require.NoError(t, sandbox.Restore(ctx, "seeded"))
+	assert.Equal(t, dbName, sandbox.DBName)
+	assert.Equal(t, 3, count(sandbox))
+
+	fresh, err := m.NewFromCheckpoint(ctx, "seeded")
+	require.NoError(t, err)
+	assert.NotEqual(t, sandbox.DBName, fresh.DBName)
+	assert.Equal(t, 3, count(fresh))
+	require.NoError(t, fresh.Close())
+
+	ckpt, ok := m.checkpoints.get("seeded")
+	require.True(t, ok)
+
+	require.NoError(t, sandbox.Close())
+	require.NoError(t, m.Close())
+
+	adminDB, err := openAdminDB(ctx, m.Config())
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	var exists bool
+	require.NoError(t, adminDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_database WHERE datname = $1)", ckpt.dbName).Scan(&exists))
+	assert.False(t, exists)
+}
+
+func TestCheckpointWithoutManager(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_ckpt_"
+
+	sandbox := NewT(t, getTestDBURL(), config)
+	_, err := sandbox.DB().ExecContext(ctx, "CREATE TABLE ckpt_marker (id int)")
+	require.NoError(t, err)
+	require.NoError(t, sandbox.Checkpoint(ctx, "without_manager"))
+	t.Cleanup(func() { assert.NoError(t, DropCheckpoints(context.Background())) })
+
+	fresh, err := NewFromCheckpoint(ctx, "without_manager")
+	require.NoError(t, err)
+	defer fresh.Close()
+
+	var exists bool
+	require.NoError(t, fresh.DB().QueryRowContext(ctx, "SELECT to_regclass('ckpt_marker') IS NOT NULL").Scan(&exists))
+	assert.True(t, exists)
+}
+
+func TestCheckpointDroppedWithTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_ckpt_"
+
+	var dbName string
+	t.Run("seed", func(t *testing.T) {
+		sandbox := NewT(t, getTestDBURL(), config)
+		require.NoError(t, sandbox.Checkpoint(ctx, "dropped_with_test"))
+		ckpt, ok := checkpoints.get("dropped_with_test")
+		require.True(t, ok)
+		dbName = ckpt.dbName
+	})
+
+	_, ok := checkpoints.get("dropped_with_test")
+	assert.False(t, ok)
+
+	adminDB, err := openAdminDB(ctx, &Config{MainDBURL: getTestDBURL()})
+	require.NoError(t, err)
+	defer adminDB.Close()
+	assert.False(t, databaseExists(t, adminDB, dbName))
+}
+
+func TestCheckpointParallelCollision(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_ckpt_"
+
+	// Both sandboxes checkpoint before either test completes and drops its checkpoint
+	var failed atomic.Int32
+	var checkpointed sync.WaitGroup
+	checkpointed.Add(2)
+	t.Run("group", func(t *testing.T) {
+		for _, table := range []string{"ckpt_first", "ckpt_second"} {
+			t.Run(table, func(t *testing.T) {
+				t.Parallel()
+				done := sync.OnceFunc(checkpointed.Done)
+				defer done()
+
+				sandbox := NewT(t, getTestDBURL(), config)
+				_, err := sandbox.DB().ExecContext(ctx, "CREATE TABLE "+table+" (id int)")
+				require.NoError(t, err)
+
+				err = sandbox.Checkpoint(ctx, "parallel_seeded")
+				done()
+				checkpointed.Wait()
+				if err != nil {
+					assert.ErrorContains(t, err, "already exists for another sandbox")
+					failed.Add(1)
+					return
+				}
+
+				// The checkpoint still holds the state of this sandbox
+				_, err = sandbox.DB().ExecContext(ctx, "DROP TABLE "+table)
+				require.NoError(t, err)
+				require.NoError(t, sandbox.Restore(ctx, "parallel_seeded"))
+				var exists bool
+				require.NoError(t, sandbox.DB().QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists))
+				assert.True(t, exists)
+			})
+		}
+	})
+	assert.Equal(t, int32(1), failed.Load())
+}
@@ -0,0 +1,637 @@
+package sql_sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ConnString is a parsed PostgreSQL connection string in either format libpq accepts:
+// keyword/value pairs ("host=localhost dbname='my db'") or a URI
+// ("postgres://user@host1:5432,host2:5433/app?sslmode=disable"). Parameters keep their
+// order, and String renders them in the format they were parsed from.
+type ConnString struct {
+	uri    bool
+	scheme string
+	params []connParam
+}
+
+type connParam struct {
+	key   string
+	value string
+}
+
+// envDefaults lists the environment variables libpq reads parameter defaults from
+var envDefaults = []struct {
+	key string
+	env string
+}{
+	{"host", "PGHOST"},
+	{"hostaddr", "PGHOSTADDR"},
+	{"port", "PGPORT"},
+	{"dbname", "PGDATABASE"},
+	{"user", "PGUSER"},
+	{"password", "PGPASSWORD"},
+	{"passfile", "PGPASSFILE"},
+	{"channel_binding", "PGCHANNELBINDING"},
+	{"options", "PGOPTIONS"},
+	{"application_name", "PGAPPNAME"},
+	{"sslmode", "PGSSLMODE"},
+	{"sslnegotiation", "PGSSLNEGOTIATION"},
+	{"sslcompression", "PGSSLCOMPRESSION"},
+	{"sslcert", "PGSSLCERT"},
+	{"sslkey", "PGSSLKEY"},
+	{"sslcertmode", "PGSSLCERTMODE"},
+	{"sslrootcert", "PGSSLROOTCERT"},
+	{"sslcrl", "PGSSLCRL"},
+	{"sslcrldir", "PGSSLCRLDIR"},
+	{"sslsni", "PGSSLSNI"},
+	{"requirepeer", "PGREQUIREPEER"},
+	{"ssl_min_protocol_version", "PGSSLMINPROTOCOLVERSION"},
+	{"ssl_max_protocol_version", "PGSSLMAXPROTOCOLVERSION"},
+	{"gssencmode", "PGGSSENCMODE"},
+	{"krbsrvname", "PGKRBSRVNAME"},
+	{"gsslib", "PGGSSLIB"},
+	{"gssdelegation", "PGGSSDELEGATION"},
+	{"connect_timeout", "PGCONNECT_TIMEOUT"},
+	{"client_encoding", "PGCLIENTENCODING"},
+	{"target_session_attrs", "PGTARGETSESSIONATTRS"},
+	{"load_balance_hosts", "PGLOADBALANCEHOSTS"},
+}
+
+// ParseConnString parses a connection string in keyword/value or URI format
+func ParseConnString(s string) (*ConnString, error) {
+	for _, prefix := range []string{"postgresql://", "postgres://"} {
+		if rest, ok := strings.CutPrefix(s, prefix); ok {
+			return parseConnURI(strings.TrimSuffix(prefix, "://"), rest)
+		}
+	}
+	return parseConnKeywordValue(s)
+}
+
+// parseConnKeywordValue parses keyword/value pairs separated by whitespace. Values may
+// be single-quoted, and backslashes escape the following character.
+func parseConnKeywordValue(s string) (*ConnString, error) {
+	c := &ConnString{}
+	i := 0
+	for {
+		i = skipConnSpace(s, i)
+		if i >= len(s) {
+			return c, nil
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && !isConnSpace(s[i]) {
+			i++
+		}
+		key := s[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("missing keyword before \"=\" in connection string")
+		}
+
+		i = skipConnSpace(s, i)
+		if i >= len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", key)
+		}
+		i = skipConnSpace(s, i+1)
+
+		var value strings.Builder
+		if i < len(s) && s[i] == '\'' {
+			i++
+			closed := false
+			for i < len(s) {
+				if s[i] == '\\' {
+					i++
+					if i < len(s) {
+						value.WriteByte(s[i])
+						i++
+					}
+					continue
+				}
+				if s[i] == '\'' {
+					closed = true
+					i++
+					break
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted string in connection string")
+			}
+		} else {
+			for i < len(s) && !isConnSpace(s[i]) {
+				if s[i] == '\\' {
+					i++
+					if i >= len(s) {
+						break
+					}
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+		}
+
+		c.params = append(c.params, connParam{key: key, value: value.String()})
+	}
+}
+
+// parseConnURI parses the part of a URI after "postgres://":
+// [user[:password]@][host][:port][,...][/dbname][?param=value&...]
+func parseConnURI(scheme, s string) (*ConnString, error) {
+	c := &ConnString{uri: true, scheme: scheme}
+
+	s, query, hasQuery := strings.Cut(s, "?")
+	netloc, path, hasPath := strings.Cut(s, "/")
+
+	if userinfo, hostspec, ok := strings.Cut(netloc, "@"); ok {
+		netloc = hostspec
+		username, password, hasPassword := strings.Cut(userinfo, ":")
+		if err := c.addUnescaped("user", username); err != nil {
+			return nil, err
+		}
+		if hasPassword {
+			if err := c.addUnescaped("password", password); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if netloc != "" {
+		var hosts, ports []string
+		hasHost, hasPort := false, false
+		for _, spec := range strings.Split(netloc, ",") {
+			host, port := spec, ""
+			if strings.HasPrefix(spec, "[") {
+				end := strings.IndexByte(spec, ']')
+				if end < 0 {
+					return nil, fmt.Errorf("missing \"]\" in IPv6 host address of connection URI")
+				}
+				host, port = spec[1:end], spec[end+1:]
+				if port != "" && port[0] != ':' {
+					return nil, fmt.Errorf("unexpected character after IPv6 host address in connection URI")
+				}
+				port = strings.TrimPrefix(port, ":")
+			} else if before, after, ok := strings.Cut(spec, ":"); ok {
+				host, port = before, after
+			}
+
+			host, err := url.PathUnescape(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host in connection URI: %w", err)
+			}
+			port, err = url.PathUnescape(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in connection URI: %w", err)
+			}
+			hosts, ports = append(hosts, host), append(ports, port)
+			hasHost, hasPort = hasHost || host != "", hasPort || port != ""
+		}
+		if hasHost {
+			c.params = append(c.params, connParam{key: "host", value: strings.Join(hosts, ",")})
+		}
+		if hasPort {
+			c.params = append(c.params, connParam{key: "port", value: strings.Join(ports, ",")})
+		}
+	}
+
+	if hasPath && path != "" {
+		if err := c.addUnescaped("dbname", path); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasQuery && query != "" {
+		for _, pair := range strings.Split(query, "&") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("missing \"=\" in connection URI parameter %q", pair)
+			}
+			key, err := url.PathUnescape(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid connection URI parameter: %w", err)
+			}
+			if err := c.addUnescaped(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// addUnescaped adds a percent-encoded URI component as parameter, skipping empty values
+func (c *ConnString) addUnescaped(key, value string) error {
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s in connection URI: %w", key, err)
+	}
+	if unescaped != "" {
+		c.params = append(c.params, connParam{key: key, value: unescaped})
+	}
+	return nil
+}
+
+// IsURI reports whether the connection string was parsed from a URI
+func (c *ConnString) IsURI() bool {
+	return c.uri
+}
+
+// Get returns the value of a parameter. Like libpq, the last occurrence wins.
+func (c *ConnString) Get(key string) (string, bool) {
+	for i := len(c.params) - 1; i >= 0; i-- {
+		if c.params[i].key == key {
+			return c.params[i].value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets a parameter, replacing its first occurrence and removing any others
+func (c *ConnString) Set(key, value string) {
+	found := false
+	params := c.params[:0]
+	for _, p := range c.params {
+		if p.key == key {
+			if found {
+				continue
+			}
+			found = true
+			p.value = value
+		}
+		params = append(params, p)
+	}
+	c.params = params
+	if !found {
+		c.params = append(c.params, connParam{key: key, value: value})
+	}
+}
+
+// Del removes a parameter
+func (c *ConnString) Del(key string) {
+	params := c.params[:0]
+	for _, p := range c.params {
+		if p.key != key {
+			params = append(params, p)
+		}
+	}
+	c.params = params
+}
+
+// Keys returns the names of the parameters that are set, in order of first occurrence
+func (c *ConnString) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, p := range c.params {
+		if !seen[p.key] {
+			seen[p.key] = true
+			keys = append(keys, p.key)
+		}
+	}
+	return keys
+}
+
+// String renders the connection string in the format it was parsed from
+func (c *ConnString) String() string {
+	if c.uri {
+		return c.uriString()
+	}
+
+	parts := make([]string, 0, len(c.params))
+	for _, p := range c.params {
+		parts = append(parts, p.key+"="+quoteConnValue(p.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// uriString renders the parameters as URI. User, password, host, port and database
+// name go into their URI components where they can be represented; everything else
+// goes into the query, sorted by name.
+func (c *ConnString) uriString() string {
+	var b strings.Builder
+	b.WriteString(c.scheme + "://")
+	inline := make(map[string]bool)
+
+	username, hasUser := c.Get("user")
+	password, hasPassword := c.Get("password")
+	if hasUser {
+		if hasPassword {
+			b.WriteString(url.UserPassword(username, password).String())
+			inline["password"] = true
+		} else {
+			b.WriteString(url.User(username).String())
+		}
+		b.WriteByte('@')
+		inline["user"] = true
+	}
+
+	host, _ := c.Get("host")
+	port, _ := c.Get("port")
+	if authority, portInline, ok := uriAuthority(host, port); ok {
+		b.WriteString(authority)
+		inline["host"] = true
+		inline["port"] = portInline
+	}
+
+	if dbname, ok := c.Get("dbname"); ok {
+		b.WriteString("/" + url.PathEscape(dbname))
+		inline["dbname"] = true
+	}
+
+	var query []string
+	for _, key := range c.Keys() {
+		if inline[key] {
+			continue
+		}
+		value, _ := c.Get(key)
+		query = append(query, escapeURIComponent(key)+"="+escapeURIComponent(value))
+	}
+	if len(query) > 0 {
+		sort.Strings(query)
+		b.WriteString("?" + strings.Join(query, "&"))
+	}
+
+	return b.String()
+}
+
+// uriAuthority renders hosts and ports as URI authority and reports whether the port
+// is part of it. It reports false for hosts that cannot be represented there, such as
+// Unix socket directories.
+func uriAuthority(host, port string) (string, bool, bool) {
+	if strings.ContainsAny(host+port, "/?#@%[]") {
+		return "", false, false
+	}
+
+	hosts := strings.Split(host, ",")
+	var ports []string
+	if port != "" {
+		ports = strings.Split(port, ",")
+	}
+	if len(ports) > 1 && len(ports) != len(hosts) {
+		return "", false, false
+	}
+	// A single port applies to all hosts and is rendered as query parameter
+	portInline := len(ports) == len(hosts)
+
+	parts := make([]string, len(hosts))
+	for i, h := range hosts {
+		if strings.Contains(h, ":") {
+			h = "[" + h + "]"
+		}
+		if portInline {
+			h += ":" + ports[i]
+		}
+		parts[i] = h
+	}
+	return strings.Join(parts, ","), portInline || port == "", true
+}
+
+// escapeURIComponent percent-encodes a query component without encoding spaces as "+",
+// which libpq would not decode
+func escapeURIComponent(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// quoteConnValue quotes a keyword/value parameter value where necessary
+func quoteConnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\v\f\r'\\") {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+func isConnSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+func skipConnSpace(s string, i int) int {
+	for i < len(s) && isConnSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+// Settings returns the effective connection parameters the way libpq determines them:
+// parameters of the connection string first, then the entry of the service named by
+// the service parameter or PGSERVICE, then the PG* environment variables, then the
+// built-in defaults. A password that is still missing is looked up in the password
+// file named by passfile or PGPASSFILE, defaulting to ~/.pgpass.
+func (c *ConnString) Settings() (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, p := range c.params {
+		settings[p.key] = p.value
+	}
+
+	service, ok := settings["service"]
+	if !ok {
+		service = os.Getenv("PGSERVICE")
+	}
+	if service != "" {
+		params, err := lookupService(service)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range params {
+			if _, ok := settings[key]; !ok {
+				settings[key] = value
+			}
+		}
+	}
+
+	for _, d := range envDefaults {
+		if _, ok := settings[d.key]; ok {
+			continue
+		}
+		if value := os.Getenv(d.env); value != "" {
+			settings[d.key] = value
+		}
+	}
+
+	if _, ok := settings["host"]; !ok {
+		settings["host"] = "localhost"
+	}
+	if _, ok := settings["port"]; !ok {
+		settings["port"] = "5432"
+	}
+	if _, ok := settings["user"]; !ok {
+		if u, err := user.Current(); err == nil {
+			settings["user"] = u.Username
+		}
+	}
+	if _, ok := settings["dbname"]; !ok {
+		settings["dbname"] = settings["user"]
+	}
+	if _, ok := settings["password"]; !ok {
+		if password, ok := lookupPassword(settings); ok {
+			settings["password"] = password
+		}
+	}
+
+	return settings, nil
+}
+
+// lookupService returns the parameters of a service from the user's service file
+// (PGSERVICEFILE or ~/.pg_service.conf) or else the system-wide one in PGSYSCONFDIR
+func lookupService(service string) (map[string]string, error) {
+	var files []string
+	if file := os.Getenv("PGSERVICEFILE"); file != "" {
+		files = append(files, file)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "pg_service.conf"))
+	}
+
+	for _, file := range files {
+		params, found, err := readServiceFile(file, service)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("definition of service %q not found", service)
+}
+
+// readServiceFile reads the parameters of a service from an INI-style service file.
+// A missing file is not an error.
+func readServiceFile(file, service string) (map[string]string, bool, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open service file: %w", err)
+	}
+	defer f.Close()
+
+	var params map[string]string
+	inService := false
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if text[0] == '[' {
+			if inService {
+				break
+			}
+			inService = strings.TrimSuffix(text[1:], "]") == service
+			if inService {
+				params = make(map[string]string)
+			}
+			continue
+		}
+		if !inService {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, false, fmt.Errorf("syntax error in service file %q, line %d", file, line)
+		}
+		params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to read service file: %w", err)
+	}
+	return params, params != nil, nil
+}
+
+// lookupPassword returns the password for the first host from the password file
+func lookupPassword(settings map[string]string) (string, bool) {
+	file := settings["passfile"]
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		file = filepath.Join(home, ".pgpass")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	host, _, _ := strings.Cut(settings["host"], ",")
+	if host == "" || strings.HasPrefix(host, "/") {
+		// Unix socket connections match entries for localhost
+		host = "localhost"
+	}
+	port, _, _ := strings.Cut(settings["port"], ",")
+	want := []string{host, port, settings["dbname"], settings["user"]}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := splitPassfileLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matches := true
+		for i, value := range want {
+			if fields[i] != "*" && fields[i] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4], true
+		}
+	}
+	return "", false
+}
+
+// splitPassfileLine splits a password file line on colons, honoring backslash escapes
+func splitPassfileLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				field.WriteByte(line[i])
+			}
+		case ':':
+			if len(fields) < 4 {
+				fields = append(fields, field.String())
+				field.Reset()
+				continue
+			}
+			field.WriteByte(':')
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// connDBName returns the database a connection string connects to, taking the service
+// file and PG* environment variables into account
+func connDBName(connStr string) string {
+	if c, err := ParseConnString(connStr); err == nil {
+		if settings, err := c.Settings(); err == nil {
+			return settings["dbname"]
+		}
+	}
+	return ExtractDBName(connStr)
+}
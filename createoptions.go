@@ -0,0 +1,195 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CreateOptions are options of the CREATE DATABASE statements creating the template
+// and the sandbox databases. Empty fields are left to the server defaults. Encoding and
+// locale are set on the template only, which requires MigrateTemplate with TemplateBase
+// template0, and are inherited by the sandboxes.
+type CreateOptions struct {
+	// Strategy is WAL_LOG, the default since PostgreSQL 15, or FILE_COPY, which is
+	// much faster for large templates. Requires PostgreSQL 15.
+	Strategy string
+	// Owner is the role owning the databases
+	Owner string
+	// Tablespace is the default tablespace of the databases, e.g. a RAM-backed one
+	Tablespace string
+	// Encoding is the character set encoding, e.g. UTF8
+	Encoding string
+	// Locale sets LC_COLLATE and LC_CTYPE at once. Requires PostgreSQL 13.
+	Locale string
+	// LCCollate is the collation order
+	LCCollate string
+	// LCCtype is the character classification
+	LCCtype string
+	// LocaleProvider is libc, icu or, since PostgreSQL 17, builtin. Requires PostgreSQL 15.
+	LocaleProvider string
+	// ICULocale is the ICU locale with LocaleProvider icu. Requires PostgreSQL 15.
+	ICULocale string
+}
+
+// createOption is a CREATE DATABASE option with the server version introducing it
+type createOption struct {
+	name       string
+	value      string
+	minVersion int
+}
+
+// options returns the options that are set, in the order of the CREATE DATABASE synopsis
+func (o *CreateOptions) options() []createOption {
+	if o == nil {
+		return nil
+	}
+	all := []createOption{
+		{"OWNER", o.Owner, 0},
+		{"STRATEGY", o.Strategy, 150000},
+		{"ENCODING", o.Encoding, 0},
+		{"LOCALE", o.Locale, 130000},
+		{"LC_COLLATE", o.LCCollate, 0},
+		{"LC_CTYPE", o.LCCtype, 0},
+		{"LOCALE_PROVIDER", o.LocaleProvider, 150000},
+		{"ICU_LOCALE", o.ICULocale, 150000},
+		{"TABLESPACE", o.Tablespace, 0},
+	}
+	var set []createOption
+	for _, option := range all {
+		if option.value != "" {
+			set = append(set, option)
+		}
+	}
+	return set
+}
+
+// validate checks the options before any of them is sent to the server
+func (o *CreateOptions) validate() error {
+	for _, option := range o.options() {
+		switch option.name {
+		case "OWNER":
+			if err := validateIdentifier("database owner", option.value); err != nil {
+				return err
+			}
+		case "TABLESPACE":
+			if err := validateIdentifier("tablespace name", option.value); err != nil {
+				return err
+			}
+		case "STRATEGY":
+			switch strings.ToLower(option.value) {
+			case "wal_log", "file_copy":
+			default:
+				return fmt.Errorf("unknown CREATE DATABASE strategy %q, expected WAL_LOG or FILE_COPY", option.value)
+			}
+		case "LOCALE_PROVIDER":
+			switch strings.ToLower(option.value) {
+			case "libc", "icu", "builtin":
+			default:
+				return fmt.Errorf("unknown locale provider %q, expected libc, icu or builtin", option.value)
+			}
+		default:
+			if strings.ContainsRune(option.value, 0) {
+				return fmt.Errorf("CREATE DATABASE option %s must not contain NUL characters", option.name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkVersion reports the first option the server does not support
+func (o *CreateOptions) checkVersion(serverVersion int) error {
+	for _, option := range o.options() {
+		minVersion := option.minVersion
+		if option.name == "LOCALE_PROVIDER" && strings.EqualFold(option.value, "builtin") {
+			minVersion = 170000
+		}
+		if serverVersion < minVersion {
+			return fmt.Errorf("%w: CREATE DATABASE option %s %s requires PostgreSQL %d, the server runs %s",
+				ErrUnsupportedOption, option.name, option.value, minVersion/10000, formatServerVersion(serverVersion))
+		}
+	}
+	return nil
+}
+
+// templateOnly reports whether the option only applies to the template. Encoding and
+// locale are inherited by the databases cloned from it and cannot differ from it.
+func (c createOption) templateOnly() bool {
+	switch c.name {
+	case "ENCODING", "LOCALE", "LC_COLLATE", "LC_CTYPE", "LOCALE_PROVIDER", "ICU_LOCALE":
+		return true
+	}
+	return false
+}
+
+// checkTemplateBase reports encoding and locale options the template cannot be created
+// with. PostgreSQL only allows them to differ from the source database when cloning
+// template0, which the template is created from with MigrateTemplate.
+func (o *CreateOptions) checkTemplateBase(config *Config) error {
+	if config.MigrateTemplate && templateBase(config) == "template0" {
+		return nil
+	}
+	for _, option := range o.options() {
+		if option.templateOnly() {
+			return fmt.Errorf("%w: CREATE DATABASE option %s requires MigrateTemplate with TemplateBase template0, databases cloned from another source keep its encoding and locale",
+				ErrUnsupportedOption, option.name)
+		}
+	}
+	return nil
+}
+
+// clause returns the options as they follow CREATE DATABASE name TEMPLATE template
+// when creating the template database
+func (o *CreateOptions) clause() string {
+	return optionsClause(o.options())
+}
+
+// cloneClause returns the options for databases cloned from the template, without
+// the encoding and locale they inherit from it
+func (o *CreateOptions) cloneClause() string {
+	var options []createOption
+	for _, option := range o.options() {
+		if !option.templateOnly() {
+			options = append(options, option)
+		}
+	}
+	return optionsClause(options)
+}
+
+// optionsClause formats options as they follow CREATE DATABASE name TEMPLATE template
+func optionsClause(options []createOption) string {
+	var b strings.Builder
+	for _, option := range options {
+		b.WriteString(" " + option.name + " ")
+		switch option.name {
+		case "OWNER", "TABLESPACE":
+			b.WriteString(quoteIdentifier(option.value))
+		default:
+			b.WriteString(quoteLiteral(option.value))
+		}
+	}
+	return b.String()
+}
+
+// serverVersion returns the server version as server_version_num, e.g. 150004
+func serverVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var versionNum string
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&versionNum); err != nil {
+		return 0, fmt.Errorf("failed to determine server version: %w", err)
+	}
+	version, err := strconv.Atoi(versionNum)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse server version %q: %w", versionNum, err)
+	}
+	return version, nil
+}
+
+// formatServerVersion formats a server_version_num like 150004 as 15.4
+func formatServerVersion(version int) string {
+	if version < 100000 {
+		return fmt.Sprintf("%d.%d.%d", version/10000, version/100%100, version%100)
+	}
+	return fmt.Sprintf("%d.%d", version/10000, version%10000)
+}
@@ -0,0 +1,126 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateOptionsClause(t *testing.T) {
+	var nilOptions *CreateOptions
+	assert.Equal(t, "", nilOptions.clause())
+	assert.Equal(t, "", (&CreateOptions{}).clause())
+
+	options := &CreateOptions{
+		Strategy:       "FILE_COPY",
+		Owner:          "app owner",
+		Tablespace:     "ramdisk",
+		Encoding:       "UTF8",
+		LCCollate:      "C",
+		LocaleProvider: "icu",
+		ICULocale:      "en-US",
+	}
+	assert.Equal(t, ` OWNER "app owner" STRATEGY 'FILE_COPY' ENCODING 'UTF8' LC_COLLATE 'C' LOCALE_PROVIDER 'icu' ICU_LOCALE 'en-US' TABLESPACE "ramdisk"`, options.clause())
+
+	// Clones inherit encoding and locale from the template
+	assert.Equal(t, ` OWNER "app owner" STRATEGY 'FILE_COPY' TABLESPACE "ramdisk"`, options.cloneClause())
+	assert.Equal(t, "", nilOptions.cloneClause())
+}
+
+func TestCreateOptionsCheckTemplateBase(t *testing.T) {
+	options := &CreateOptions{Strategy: "FILE_COPY", Owner: "app"}
+	assert.NoError(t, options.checkTemplateBase(DefaultConfig()))
+
+	for _, options := range []*CreateOptions{
+		{Encoding: "UTF8"}, {Locale: "C"}, {LCCollate: "C"}, {LCCtype: "C"}, {LocaleProvider: "icu"}, {ICULocale: "en-US"},
+	} {
+		config := DefaultConfig()
+		err := options.checkTemplateBase(config)
+		require.ErrorIs(t, err, ErrUnsupportedOption)
+		assert.Contains(t, err.Error(), "requires MigrateTemplate with TemplateBase template0")
+
+		config.MigrateTemplate = true
+		assert.NoError(t, options.checkTemplateBase(config))
+
+		config.TemplateBase = "template1"
+		assert.ErrorIs(t, options.checkTemplateBase(config), ErrUnsupportedOption)
+	}
+
+	// validateConfig rejects them before anything is sent to the server
+	config := DefaultConfig()
+	config.CreateOptions = &CreateOptions{Locale: "C"}
+	assert.ErrorIs(t, validateConfig(config), ErrUnsupportedOption)
+}
+
+func TestCreateOptionsValidate(t *testing.T) {
+	var nilOptions *CreateOptions
+	assert.NoError(t, nilOptions.validate())
+	assert.NoError(t, (&CreateOptions{Strategy: "file_copy", LocaleProvider: "builtin"}).validate())
+
+	assert.ErrorIs(t, (&CreateOptions{Owner: strings.Repeat("a", 64)}).validate(), ErrInvalidIdentifier)
+	assert.Error(t, (&CreateOptions{Strategy: "fast"}).validate())
+	assert.Error(t, (&CreateOptions{LocaleProvider: "posix"}).validate())
+	assert.Error(t, (&CreateOptions{Locale: "C\x00"}).validate())
+}
+
+func TestCreateOptionsCheckVersion(t *testing.T) {
+	options := &CreateOptions{Encoding: "UTF8", Strategy: "FILE_COPY"}
+	assert.NoError(t, options.checkVersion(150004))
+
+	err := options.checkVersion(140011)
+	require.ErrorIs(t, err, ErrUnsupportedOption)
+	assert.Contains(t, err.Error(), "STRATEGY FILE_COPY requires PostgreSQL 15, the server runs 14.11")
+
+	assert.ErrorIs(t, (&CreateOptions{Locale: "C"}).checkVersion(120000), ErrUnsupportedOption)
+	assert.ErrorIs(t, (&CreateOptions{LocaleProvider: "builtin"}).checkVersion(160002), ErrUnsupportedOption)
+	assert.NoError(t, (&CreateOptions{LocaleProvider: "icu"}).checkVersion(160002))
+}
+
+func TestFormatServerVersion(t *testing.T) {
+	assert.Equal(t, "15.4", formatServerVersion(150004))
+	assert.Equal(t, "9.6.24", formatServerVersion(90624))
+}
+
+func TestSandboxCreateOptions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	mainDBURL := getTestDBURL()
+
+	adminDB, err := sql.Open("postgres", ReplaceDBName(mainDBURL, "postgres"))
+	require.NoError(t, err)
+	defer adminDB.Close()
+	version, err := serverVersion(ctx, adminDB)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_create_opts_"
+	config.TemplateDBName = "template_create_opts"
+	config.MigrateTemplate = true
+	config.CreateOptions = &CreateOptions{Encoding: "UTF8", LCCollate: "C", LCCtype: "C", Strategy: "FILE_COPY"}
+
+	if version < 150000 {
+		_, err := NewManager(ctx, mainDBURL, config)
+		require.ErrorIs(t, err, ErrUnsupportedOption)
+		config.CreateOptions.Strategy = ""
+	}
+
+	manager, err := NewManager(ctx, mainDBURL, config)
+	require.NoError(t, err)
+	defer manager.Close()
+
+	sandbox, err := manager.New(ctx)
+	require.NoError(t, err)
+	defer sandbox.Close()
+
+	var collate string
+	require.NoError(t, sandbox.DB().QueryRowContext(ctx,
+		"SELECT datcollate FROM pg_database WHERE datname = current_database()").Scan(&collate))
+	assert.Equal(t, "C", collate)
+}
@@ -0,0 +1,146 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// Driver selects the database/sql driver used for admin and sandbox connections
+type Driver string
+
+const (
+	// DriverPQ uses github.com/lib/pq, the default
+	DriverPQ Driver = "postgres"
+	// DriverPgx uses github.com/jackc/pgx/v5 through its database/sql adapter
+	DriverPgx Driver = "pgx"
+)
+
+// driverName returns the database/sql driver name of the configured driver
+func driverName(config *Config) string {
+	if config == nil || config.Driver == "" {
+		return string(DriverPQ)
+	}
+	return string(config.Driver)
+}
+
+// openDB opens a database/sql connection pool with the configured driver
+func openDB(config *Config, connStr string) (*sql.DB, error) {
+	return sql.Open(driverName(config), connStr)
+}
+
+// newConnector creates a database/sql connector for the configured driver
+func newConnector(config *Config, connStr string) (driver.Connector, error) {
+	switch Driver(driverName(config)) {
+	case DriverPgx:
+		connConfig, err := pgx.ParseConfig(connStr)
+		if err != nil {
+			return nil, err
+		}
+		return stdlib.GetConnector(*connConfig), nil
+	case DriverPQ:
+		return pq.NewConnector(connStr)
+	default:
+		return nil, fmt.Errorf("unsupported driver %q", config.Driver)
+	}
+}
+
+// PgxPool returns a pgx connection pool for the sandbox database, created on first use
+// and closed together with the sandbox. It is available independently of Config.Driver,
+// but not with IsolationTransaction, whose changes are only visible on the connection of DB.
+func (s *Sandbox) PgxPool(ctx context.Context) (*pgxpool.Pool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pgxPool != nil {
+		return s.pgxPool, nil
+	}
+
+	connStr, err := s.connString("pgx connections")
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	if s.Config.MaxConnections > 0 {
+		poolConfig.MaxConns = int32(s.Config.MaxConnections)
+	}
+	if s.Config.ConnectionTimeout > 0 {
+		poolConfig.MaxConnLifetime = s.Config.ConnectionTimeout
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to test database: %w", err)
+	}
+
+	// Test test database connection with context
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping test database: %w", err)
+	}
+
+	s.pgxPool = pool
+	return pool, nil
+}
+
+// PgxConn opens a new pgx connection to the sandbox database, e.g. for LISTEN.
+// It may be closed by the caller and is closed together with the sandbox otherwise.
+// Like PgxPool it is not available with IsolationTransaction.
+func (s *Sandbox) PgxConn(ctx context.Context) (*pgx.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	connStr, err := s.connString("pgx connections")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to test database: %w", err)
+	}
+
+	s.pgxConns = append(s.pgxConns, conn)
+	return conn, nil
+}
+
+// connString returns the connection string of the sandbox database for additional
+// connections, which are not available with IsolationTransaction
+func (s *Sandbox) connString(what string) (string, error) {
+	switch {
+	case s.tx != nil:
+		return "", fmt.Errorf("%s are not supported with IsolationTransaction", what)
+	case s.closed || s.DBName == "":
+		return "", fmt.Errorf("sandbox is closed")
+	case s.Schema != "":
+		return schemaConnString(s.Config, s.Schema), nil
+	default:
+		return ReplaceDBName(s.Config.MainDBURL, s.DBName), nil
+	}
+}
+
+// closePgx closes the pgx pool and connections of the sandbox
+func (s *Sandbox) closePgx() error {
+	var err error
+	if s.pgxPool != nil {
+		s.pgxPool.Close()
+		s.pgxPool = nil
+	}
+	for _, conn := range s.pgxConns {
+		if closeErr := conn.Close(context.Background()); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close pgx connection: %w", closeErr)
+		}
+	}
+	s.pgxConns = nil
+	return err
+}
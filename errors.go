@@ -0,0 +1,99 @@
+package sql_sandbox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDatabaseExists is reported when a database to be created already exists
+	ErrDatabaseExists = errors.New("database already exists")
+	// ErrTemplateBusy is reported when a database cannot be cloned because other
+	// sessions are connected to the template
+	ErrTemplateBusy = errors.New("template database is being accessed by other users")
+	// ErrDatabaseInUse is reported when a database cannot be dropped because other
+	// sessions are connected to it
+	ErrDatabaseInUse = errors.New("database is being accessed by other users")
+	// ErrPermissionDenied is reported when the role lacks the privilege for an operation,
+	// e.g. CREATEDB
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrInvalidIdentifier is reported when a configured name cannot be used as a
+	// PostgreSQL identifier, e.g. because it is longer than 63 bytes
+	ErrInvalidIdentifier = errors.New("invalid identifier")
+	// ErrUnsupportedOption is reported when a configured option is not supported by the
+	// server version, e.g. CreateOptions.Strategy before PostgreSQL 15
+	ErrUnsupportedOption = errors.New("option not supported by server")
+)
+
+// PostgreSQL error codes (SQLSTATE) the sandbox reacts to
+const (
+	codeUniqueViolation       = "23505"
+	codeInsufficientPrivilege = "42501"
+	codeSyntaxError           = "42601"
+	codeDuplicateDatabase     = "42P04"
+	codeInvalidCatalogName    = "3D000"
+	codeObjectInUse           = "55006"
+)
+
+// Database operations reported in DatabaseError
+const (
+	OpCreate = "create"
+	OpDrop   = "drop"
+)
+
+// DatabaseError describes a failed database-level operation. It matches ErrDatabaseExists,
+// ErrTemplateBusy, ErrDatabaseInUse and ErrPermissionDenied with errors.Is according to
+// the SQLSTATE of the underlying error, which can be retrieved with errors.As.
+type DatabaseError struct {
+	Op       string
+	Database string
+	Err      error
+	// Sessions describes the sessions that were connected to the template when
+	// cloning finally failed with ErrTemplateBusy
+	Sessions []string
+}
+
+// Error implements error
+func (e *DatabaseError) Error() string {
+	msg := fmt.Sprintf("%s database %q: %v", e.Op, e.Database, e.Err)
+	if len(e.Sessions) > 0 {
+		msg += fmt.Sprintf(" (connected sessions: %s)", strings.Join(e.Sessions, "; "))
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *DatabaseError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error matches one of the sentinel errors
+func (e *DatabaseError) Is(target error) bool {
+	switch errorCode(e.Err) {
+	case codeDuplicateDatabase:
+		return target == ErrDatabaseExists
+	case codeObjectInUse:
+		return (target == ErrTemplateBusy && e.Op == OpCreate) || (target == ErrDatabaseInUse && e.Op == OpDrop)
+	case codeInsufficientPrivilege:
+		return target == ErrPermissionDenied
+	}
+	return false
+}
+
+// errorCode returns the SQLSTATE of a PostgreSQL error reported by lib/pq or pgx,
+// or an empty string
+func errorCode(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
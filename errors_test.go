@@ -0,0 +1,107 @@
+package sql_sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabaseErrorIs(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       string
+		code     pq.ErrorCode
+		matches  []error
+		excludes []error
+	}{
+		{
+			name:     "duplicate database",
+			op:       OpCreate,
+			code:     codeDuplicateDatabase,
+			matches:  []error{ErrDatabaseExists},
+			excludes: []error{ErrTemplateBusy, ErrPermissionDenied},
+		},
+		{
+			name:     "template busy",
+			op:       OpCreate,
+			code:     codeObjectInUse,
+			matches:  []error{ErrTemplateBusy},
+			excludes: []error{ErrDatabaseInUse, ErrDatabaseExists},
+		},
+		{
+			name:     "database in use",
+			op:       OpDrop,
+			code:     codeObjectInUse,
+			matches:  []error{ErrDatabaseInUse},
+			excludes: []error{ErrTemplateBusy},
+		},
+		{
+			name:     "permission denied",
+			op:       OpCreate,
+			code:     codeInsufficientPrivilege,
+			matches:  []error{ErrPermissionDenied},
+			excludes: []error{ErrDatabaseExists},
+		},
+		{
+			name:     "unclassified",
+			op:       OpDrop,
+			code:     codeSyntaxError,
+			excludes: []error{ErrDatabaseExists, ErrTemplateBusy, ErrDatabaseInUse, ErrPermissionDenied},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pqErr := &pq.Error{Code: tc.code, Message: "boom"}
+			err := fmt.Errorf("failed: %w", &DatabaseError{Op: tc.op, Database: "test_db", Err: pqErr})
+
+			for _, target := range tc.matches {
+				assert.ErrorIs(t, err, target)
+			}
+			for _, target := range tc.excludes {
+				assert.NotErrorIs(t, err, target)
+			}
+
+			var dbErr *DatabaseError
+			require.ErrorAs(t, err, &dbErr)
+			assert.Equal(t, tc.op, dbErr.Op)
+			assert.Equal(t, "test_db", dbErr.Database)
+
+			var unwrapped *pq.Error
+			require.ErrorAs(t, err, &unwrapped)
+			assert.Equal(t, tc.code, unwrapped.Code)
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, codeObjectInUse, errorCode(fmt.Errorf("wrapped: %w", &pq.Error{Code: codeObjectInUse})))
+	assert.Equal(t, codeDuplicateDatabase, errorCode(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: codeDuplicateDatabase})))
+	assert.ErrorIs(t, &DatabaseError{Op: OpCreate, Database: "test_db", Err: &pgconn.PgError{Code: codeObjectInUse}}, ErrTemplateBusy)
+	assert.Empty(t, errorCode(errors.New("plain")))
+	assert.Empty(t, errorCode(nil))
+}
+
+func TestCreateTestDatabaseExists(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	sandbox, err := New(getTestDBURL(), nil)
+	require.NoError(t, err)
+	defer sandbox.Close()
+
+	adminDB, err := openAdminDB(context.Background(), sandbox.Config)
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	_, err = createTestDatabase(context.Background(), adminDB, sandbox.Config.TemplateDBName, sandbox.DBName, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrDatabaseExists)
+}
@@ -0,0 +1,127 @@
+package sql_sandbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MigrationFingerprinter is implemented by migration checkers that can describe the
+// schema they migrate to. The fingerprint is stored on the template database and the
+// template is rebuilt when it changes. Checkers without a fingerprint behave as if
+// it was empty, so their templates are only built once.
+type MigrationFingerprinter interface {
+	Fingerprint() (string, error)
+}
+
+// fingerprintCommentPrefix starts the comment set on complete template databases
+const fingerprintCommentPrefix = "sql_sandbox: fingerprint="
+
+// Fingerprint returns a hash of the migration file names and contents
+func (g *GolangMigrateChecker) Fingerprint() (string, error) {
+	return hashMigrationsDir(g.MigrationsPath)
+}
+
+// Fingerprint returns a hash of the migration file names and contents
+func (g *GooseMigrateChecker) Fingerprint() (string, error) {
+	return hashMigrationsDir(g.MigrationsPath)
+}
+
+// Fingerprint returns the user-supplied version
+func (c *CustomMigrationChecker) Fingerprint() (string, error) {
+	return c.Version, nil
+}
+
+// hashMigrationsDir returns a SHA-256 hash of the names and contents of the files in dir
+func hashMigrationsDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", fmt.Errorf("failed to read migration file: %w", err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(content))
+		h.Write(content)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// migrationFingerprint returns the fingerprint of the migration checker, if it has one
+func migrationFingerprint(migrationChecker MigrationChecker) (string, error) {
+	fingerprinter, ok := migrationChecker.(MigrationFingerprinter)
+	if !ok {
+		return "", nil
+	}
+
+	fingerprint, err := fingerprinter.Fingerprint()
+	if err != nil {
+		return "", fmt.Errorf("failed to fingerprint migrations: %w", err)
+	}
+	return fingerprint, nil
+}
+
+// templateComplete reports whether the template database exists and carries the
+// fingerprint comment. An existing template without it is dropped to be rebuilt.
+func templateComplete(ctx context.Context, adminDB *sql.DB, templateDBName, fingerprint string) (bool, error) {
+	comment, exists, err := databaseComment(ctx, adminDB, templateDBName)
+	if err != nil {
+		return false, fmt.Errorf("failed to read template fingerprint: %w", err)
+	}
+	if !exists {
+		return false, nil
+	}
+	if comment == fingerprintCommentPrefix+fingerprint {
+		return true, nil
+	}
+
+	current := "none"
+	if strings.HasPrefix(comment, fingerprintCommentPrefix) {
+		current = strings.TrimPrefix(comment, fingerprintCommentPrefix)
+	}
+	log.Printf("Template database '%s' is stale or incomplete (fingerprint %q, expected %q), rebuilding", templateDBName, current, fingerprint)
+
+	if err := dropTestDatabase(ctx, adminDB, templateDBName); err != nil {
+		return false, fmt.Errorf("failed to drop stale template database: %w", err)
+	}
+	return false, nil
+}
+
+// databaseComment returns the comment of the database and whether the database exists
+func databaseComment(ctx context.Context, adminDB *sql.DB, dbName string) (string, bool, error) {
+	var comment sql.NullString
+	err := adminDB.QueryRowContext(ctx, "SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1", dbName).Scan(&comment)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return comment.String, true, nil
+}
+
+// commentOnDatabase sets the comment of the database
+func commentOnDatabase(ctx context.Context, adminDB *sql.DB, dbName, comment string) error {
+	_, err := adminDB.ExecContext(ctx, `COMMENT ON DATABASE `+quoteIdentifier(dbName)+` IS `+quoteLiteral(comment))
+	return err
+}
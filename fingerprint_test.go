@@ -0,0 +1,111 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashMigrationsDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	write("001_users.up.sql", "CREATE TABLE users (id INT);")
+	write("001_users.down.sql", "DROP TABLE users;")
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested"), 0o755))
+
+	first, err := hashMigrationsDir(dir)
+	require.NoError(t, err)
+	again, err := hashMigrationsDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, first, again)
+
+	// Adding a migration changes the fingerprint
+	write("002_orders.up.sql", "CREATE TABLE orders (id INT);")
+	added, err := hashMigrationsDir(dir)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, added)
+
+	// Editing a migration changes the fingerprint
+	write("002_orders.up.sql", "CREATE TABLE orders (id BIGINT);")
+	edited, err := hashMigrationsDir(dir)
+	require.NoError(t, err)
+	assert.NotEqual(t, added, edited)
+
+	_, err = hashMigrationsDir(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestMigrationFingerprint(t *testing.T) {
+	fingerprint, err := migrationFingerprint(&DefaultMigrationChecker{})
+	require.NoError(t, err)
+	assert.Empty(t, fingerprint)
+
+	custom := NewCustomMigrationChecker(func(dbURL string) error { return nil })
+	custom.Version = "v42"
+	fingerprint, err = migrationFingerprint(custom)
+	require.NoError(t, err)
+	assert.Equal(t, "v42", fingerprint)
+
+	_, err = migrationFingerprint(NewGolangMigrateChecker(filepath.Join(t.TempDir(), "missing")))
+	require.Error(t, err)
+}
+
+func TestSandboxRebuildsStaleTemplate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	mainDBURL := getTestDBURL()
+	config := &Config{
+		TemplateDBName:    "template_fingerprint_test",
+		TestDBPrefix:      "test_fingerprint_",
+		MaxConnections:    5,
+		ConnectionTimeout: 10 * time.Second,
+		MigrateTemplate:   true,
+	}
+
+	adminDB, err := sql.Open("postgres", ReplaceDBName(mainDBURL, "postgres"))
+	require.NoError(t, err)
+	defer adminDB.Close()
+	require.NoError(t, dropTestDatabase(context.Background(), adminDB, config.TemplateDBName))
+	defer dropTestDatabase(context.Background(), adminDB, config.TemplateDBName)
+
+	var migrations int
+	newChecker := func(version string) *CustomMigrationChecker {
+		checker := NewCustomMigrationChecker(func(dbURL string) error {
+			migrations++
+			return nil
+		})
+		checker.Version = version
+		return checker
+	}
+
+	sandbox, err := NewWithMigrationChecker(mainDBURL, config, newChecker("v1"))
+	require.NoError(t, err)
+	require.NoError(t, sandbox.Close())
+
+	comment, _, err := databaseComment(context.Background(), adminDB, config.TemplateDBName)
+	require.NoError(t, err)
+	assert.Equal(t, fingerprintCommentPrefix+"v1", comment)
+
+	// Simulate a new test run with changed migrations
+	setupMap.Clear()
+
+	sandbox, err = NewWithMigrationChecker(mainDBURL, config, newChecker("v2"))
+	require.NoError(t, err)
+	require.NoError(t, sandbox.Close())
+
+	comment, _, err = databaseComment(context.Background(), adminDB, config.TemplateDBName)
+	require.NoError(t, err)
+	assert.Equal(t, fingerprintCommentPrefix+"v2", comment)
+	assert.Equal(t, 2, migrations)
+}
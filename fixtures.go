@@ -0,0 +1,603 @@
+package sql_sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fixtureLabelColumn is the CSV column, or the key of a row in a YAML or JSON list, that
+// holds the label of the row instead of a value
+const fixtureLabelColumn = "_label"
+
+// fixtureNull is the CSV value inserted as NULL, like with COPY
+const fixtureNull = `\N`
+
+// Fixtures are rows to seed sandboxes with, read by ReadFixtures. They are loaded into
+// every sandbox with LoadFixtures, or once into the template with Config.TemplateFixtures.
+type Fixtures struct {
+	tables []*fixtureTable
+	digest string
+}
+
+// fixtureTable holds the rows of a table from all fixture files, in file order
+type fixtureTable struct {
+	name string
+	rows []*fixtureRow
+}
+
+// fixtureRow is a row to insert, with the file it was read from for error messages
+type fixtureRow struct {
+	label  string
+	source string
+	values map[string]any
+}
+
+// FixtureRows are the labeled fixture rows as inserted, by "table.label", with the values
+// of all their columns, including those filled in by the database such as serial ids
+type FixtureRows map[string]map[string]any
+
+// ReadFixtures reads fixture files, or all fixture files of directories in lexical order.
+//
+// YAML (.yaml, .yml) and JSON (.json) files map table names to rows. The rows of a table
+// are either a list, or a map from labels to rows. CSV files (.csv) hold the rows of the
+// table named like the file, e.g. users.csv or app.users.csv, with the column names in
+// the header and \N for NULL. Their _label column labels the rows.
+//
+// String values are Go templates with the functions now, the time of loading; seq, the
+// number of the row within its table starting at 1; and ref "table.label" "column", the
+// value of a column of a labeled row inserted before, e.g. its serial id.
+func ReadFixtures(paths ...string) (*Fixtures, error) {
+	r := newFixtureReader()
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixtures: %w", err)
+		}
+		// Files are named in error messages relative to the path they were read from
+		r.root = filepath.Dir(p)
+		if err := r.read(os.DirFS(filepath.Dir(abs)), filepath.Base(abs)); err != nil {
+			return nil, err
+		}
+	}
+	return r.fixtures(), nil
+}
+
+// ReadFixturesFS reads fixture files, or all fixture files of directories, from fsys,
+// e.g. an embed.FS. See ReadFixtures for the file formats.
+func ReadFixturesFS(fsys fs.FS, paths ...string) (*Fixtures, error) {
+	r := newFixtureReader()
+	for _, p := range paths {
+		if err := r.read(fsys, p); err != nil {
+			return nil, err
+		}
+	}
+	return r.fixtures(), nil
+}
+
+// fixtureReader collects the rows of fixture files by table
+type fixtureReader struct {
+	root   string
+	tables map[string]*fixtureTable
+	order  []*fixtureTable
+	labels map[string]bool
+	files  []string
+}
+
+func newFixtureReader() *fixtureReader {
+	return &fixtureReader{
+		tables: make(map[string]*fixtureTable),
+		labels: make(map[string]bool),
+	}
+}
+
+// read reads the fixture file, or the fixture files of the directory, name
+func (r *fixtureReader) read(fsys fs.FS, name string) error {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read fixtures: %w", err)
+	}
+	if !info.IsDir() {
+		return r.readFile(fsys, name)
+	}
+
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read fixtures directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && fixtureFormat(entry.Name()) != "" {
+			if err := r.readFile(fsys, path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fixtureFormat returns the format of a fixture file by its extension, or "" if it is
+// not a fixture file
+func fixtureFormat(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		// JSON is read as the subset of YAML it is, which keeps the order of the rows
+		return "yaml"
+	case ".csv":
+		return "csv"
+	default:
+		return ""
+	}
+}
+
+// readFile reads a single fixture file
+func (r *fixtureReader) readFile(fsys fs.FS, name string) error {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read fixture file: %w", err)
+	}
+	r.files = append(r.files, fmt.Sprintf("%s\x00%d\x00%s", path.Base(name), len(content), content))
+
+	source := filepath.Join(r.root, filepath.FromSlash(name))
+	switch fixtureFormat(name) {
+	case "yaml":
+		return r.parseYAML(source, content)
+	case "csv":
+		table := strings.TrimSuffix(path.Base(name), path.Ext(name))
+		return r.parseCSV(source, table, content)
+	default:
+		return fmt.Errorf("unknown fixture file format of %s, expected .yaml, .yml, .json or .csv", source)
+	}
+}
+
+// parseYAML parses a YAML or JSON fixture file
+func (r *fixtureReader) parseYAML(source string, content []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("failed to parse fixture file %s: %w", source, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("fixture file %s must map table names to rows", source)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		table, rows := root.Content[i].Value, root.Content[i+1]
+		switch rows.Kind {
+		case yaml.SequenceNode:
+			for _, row := range rows.Content {
+				if err := r.addNode(source, table, "", row); err != nil {
+					return err
+				}
+			}
+		case yaml.MappingNode:
+			for j := 0; j+1 < len(rows.Content); j += 2 {
+				if err := r.addNode(source, table, rows.Content[j].Value, rows.Content[j+1]); err != nil {
+					return err
+				}
+			}
+		default:
+			if rows.Tag != "!!null" {
+				return fmt.Errorf("fixture file %s: rows of table %s must be a list or a map of labels to rows", source, table)
+			}
+		}
+	}
+	return nil
+}
+
+// addNode adds a row given as a YAML mapping
+func (r *fixtureReader) addNode(source, table, label string, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("fixture file %s: row of table %s must map columns to values", source, table)
+	}
+	values := make(map[string]any)
+	if err := node.Decode(&values); err != nil {
+		return fmt.Errorf("fixture file %s: invalid row of table %s: %w", source, table, err)
+	}
+
+	if value, ok := values[fixtureLabelColumn]; ok && label == "" {
+		label = fmt.Sprint(value)
+		delete(values, fixtureLabelColumn)
+	}
+	return r.add(source, table, label, values)
+}
+
+// parseCSV parses a CSV fixture file holding the rows of table
+func (r *fixtureReader) parseCSV(source, table string, content []byte) error {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to parse fixture file %s: %w", source, err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	header := records[0]
+	for _, record := range records[1:] {
+		label := ""
+		values := make(map[string]any, len(header))
+		for i, column := range header {
+			switch {
+			case column == fixtureLabelColumn:
+				label = record[i]
+			case record[i] == fixtureNull:
+				values[column] = nil
+			default:
+				values[column] = record[i]
+			}
+		}
+		if err := r.add(source, table, label, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds a row to its table, checking that its label and templates are valid
+func (r *fixtureReader) add(source, table, label string, values map[string]any) error {
+	if table == "" {
+		return fmt.Errorf("fixture file %s: table name must not be empty", source)
+	}
+	if label != "" {
+		key := table + "." + label
+		if r.labels[key] {
+			return fmt.Errorf("fixture file %s: duplicate fixture label %s", source, key)
+		}
+		r.labels[key] = true
+	}
+
+	// Report template syntax errors before anything is inserted
+	for column, value := range values {
+		if s, ok := value.(string); ok && strings.Contains(s, "{{") {
+			if _, err := parseFixtureTemplate(s, fixtureFuncs(time.Time{}, 0, nil)); err != nil {
+				return fmt.Errorf("fixture file %s: invalid template in column %s of table %s: %w", source, column, table, err)
+			}
+		}
+	}
+
+	t, ok := r.tables[table]
+	if !ok {
+		t = &fixtureTable{name: table}
+		r.tables[table] = t
+		r.order = append(r.order, t)
+	}
+	t.rows = append(t.rows, &fixtureRow{label: label, source: source, values: values})
+	return nil
+}
+
+// fixtures returns the fixtures read so far
+func (r *fixtureReader) fixtures() *Fixtures {
+	h := sha256.New()
+	for _, file := range r.files {
+		h.Write([]byte(file))
+	}
+	return &Fixtures{
+		tables: r.order,
+		digest: hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// LoadFixtures inserts the fixtures into the sandbox database and returns the labeled
+// rows. With IsolationTransaction they are inserted inside the sandbox transaction.
+func (s *Sandbox) LoadFixtures(ctx context.Context, fixtures *Fixtures) (FixtureRows, error) {
+	return fixtures.Load(ctx, s.DB())
+}
+
+// Load inserts the fixtures into db in a single transaction and returns the labeled
+// rows. Tables are filled in the order of their foreign keys, found in pg_catalog, so
+// that referenced rows are inserted first. Rows of a table are inserted in file order.
+func (f *Fixtures) Load(ctx context.Context, db *sql.DB) (FixtureRows, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tables, err := f.resolveTables(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := f.insertOrder(ctx, tx, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted := make(FixtureRows)
+	now := time.Now()
+	for _, i := range order {
+		if err := insertFixtureTable(ctx, tx, f.tables[i], tables[i].quoted, now, inserted); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit fixtures: %w", err)
+	}
+	return inserted, nil
+}
+
+// resolvedTable is a fixture table as found in pg_catalog
+type resolvedTable struct {
+	oid    int64
+	quoted string
+}
+
+// resolveTables looks up the fixture tables the way the server resolves table names,
+// including the search_path of the connection
+func (f *Fixtures) resolveTables(ctx context.Context, tx *sql.Tx) ([]resolvedTable, error) {
+	tables := make([]resolvedTable, len(f.tables))
+	for i, table := range f.tables {
+		var schema, name string
+		err := tx.QueryRowContext(ctx, `
+			SELECT c.oid::int8, n.nspname, c.relname
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = to_regclass($1)
+		`, table.name).Scan(&tables[i].oid, &schema, &name)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("fixture table %s does not exist", table.name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up fixture table %s: %w", table.name, err)
+		}
+		tables[i].quoted = quoteIdentifier(schema) + "." + quoteIdentifier(name)
+	}
+	return tables, nil
+}
+
+// insertOrder returns the indexes of the fixture tables in the order of their foreign keys
+func (f *Fixtures) insertOrder(ctx context.Context, tx *sql.Tx, tables []resolvedTable) ([]int, error) {
+	index := make(map[int64]int, len(tables))
+	for i, table := range tables {
+		index[table.oid] = i
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT conrelid::int8, confrelid::int8 FROM pg_constraint WHERE contype = 'f'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+	defer rows.Close()
+
+	deps := make([][]int, len(tables))
+	for rows.Next() {
+		var from, to int64
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+		}
+		i, ok := index[from]
+		j, okRef := index[to]
+		if ok && okRef && i != j {
+			deps[i] = append(deps[i], j)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+
+	names := make([]string, len(f.tables))
+	for i, table := range f.tables {
+		names[i] = table.name
+	}
+	return dependencyOrder(names, deps)
+}
+
+// dependencyOrder sorts the tables so that every table follows the tables it depends
+// on, keeping the original order otherwise. Self-references are ignored by the caller.
+func dependencyOrder(names []string, deps [][]int) ([]int, error) {
+	placed := make([]bool, len(names))
+	order := make([]int, 0, len(names))
+	for len(order) < len(names) {
+		progress := false
+		for i := range names {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, j := range deps[i] {
+				if !placed[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[i] = true
+				order = append(order, i)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			var cycle []string
+			for i, name := range names {
+				if !placed[i] {
+					cycle = append(cycle, name)
+				}
+			}
+			return nil, fmt.Errorf("foreign keys between fixture tables %s form a cycle", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// insertFixtureTable inserts the rows of a table and records the labeled ones
+func insertFixtureTable(ctx context.Context, tx *sql.Tx, table *fixtureTable, quoted string, now time.Time, inserted FixtureRows) error {
+	for n, row := range table.rows {
+		columns := make([]string, 0, len(row.values))
+		for column := range row.values {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		funcs := fixtureFuncs(now, n+1, inserted)
+		args := make([]any, len(columns))
+		for i, column := range columns {
+			value, err := fixtureValue(row.values[column], funcs)
+			if err != nil {
+				return fmt.Errorf("fixture file %s: column %s of table %s: %w", row.source, column, table.name, err)
+			}
+			args[i] = value
+		}
+
+		query := `INSERT INTO ` + quoted + ` DEFAULT VALUES RETURNING *`
+		if len(columns) > 0 {
+			quotedColumns := make([]string, len(columns))
+			params := make([]string, len(columns))
+			for i, column := range columns {
+				quotedColumns[i] = quoteIdentifier(column)
+				params[i] = fmt.Sprintf("$%d", i+1)
+			}
+			query = `INSERT INTO ` + quoted + ` (` + strings.Join(quotedColumns, ", ") + `) VALUES (` + strings.Join(params, ", ") + `) RETURNING *`
+		}
+
+		values, err := queryRow(ctx, tx, query, args...)
+		if err != nil {
+			return fmt.Errorf("fixture file %s: failed to insert into %s: %w", row.source, table.name, err)
+		}
+		if row.label != "" {
+			inserted[table.name+"."+row.label] = values
+		}
+	}
+	log.Printf("Loaded %d fixture rows into %s", len(table.rows), table.name)
+	return nil
+}
+
+// queryRow returns the single row of the query by column name. Text is returned as
+// string, bytea as []byte.
+func queryRow(ctx context.Context, tx *sql.Tx, query string, args ...any) (map[string]any, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+
+	values := make([]any, len(types))
+	dest := make([]any, len(types))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]any, len(types))
+	for i, column := range types {
+		value := values[i]
+		if b, ok := value.([]byte); ok && column.DatabaseTypeName() != "BYTEA" {
+			value = string(b)
+		}
+		row[column.Name()] = value
+	}
+	return row, rows.Close()
+}
+
+// fixtureFuncs returns the template functions for the row with the given number
+func fixtureFuncs(now time.Time, seq int, inserted FixtureRows) template.FuncMap {
+	return template.FuncMap{
+		"now": func() string {
+			return now.Format(time.RFC3339Nano)
+		},
+		"seq": func() int {
+			return seq
+		},
+		"ref": func(label, column string) (string, error) {
+			row, ok := inserted[label]
+			if !ok {
+				return "", fmt.Errorf("fixture row %s is not inserted before, or is not labeled", label)
+			}
+			value, ok := row[column]
+			if !ok {
+				return "", fmt.Errorf("fixture row %s has no column %s", label, column)
+			}
+			switch v := value.(type) {
+			case nil:
+				return "", fmt.Errorf("column %s of fixture row %s is NULL", column, label)
+			case time.Time:
+				return v.Format(time.RFC3339Nano), nil
+			case []byte:
+				return string(v), nil
+			default:
+				return fmt.Sprint(v), nil
+			}
+		},
+	}
+}
+
+// parseFixtureTemplate parses a templated fixture value
+func parseFixtureTemplate(text string, funcs template.FuncMap) (*template.Template, error) {
+	return template.New("fixture").Funcs(funcs).Parse(text)
+}
+
+// fixtureValue returns the value to insert for a fixture value: templates are executed,
+// and lists and maps are encoded as JSON for json and jsonb columns
+func fixtureValue(value any, funcs template.FuncMap) (any, error) {
+	switch v := value.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		tmpl, err := parseFixtureTemplate(v, funcs)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, nil); err != nil {
+			return nil, err
+		}
+		return b.String(), nil
+	case map[string]any, []any:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	default:
+		return v, nil
+	}
+}
+
+// loadTemplateFixtures loads Config.TemplateFixtures into the template database
+func loadTemplateFixtures(ctx context.Context, adminDB *sql.DB, config *Config) error {
+	db, err := openDB(config, ReplaceDBName(config.MainDBURL, config.TemplateDBName))
+	if err == nil {
+		_, err = config.TemplateFixtures.Load(ctx, db)
+		// The template must not stay connected to be cloned
+		db.Close()
+	}
+	if err != nil {
+		// Do not leave a partially seeded template behind for the next run
+		if dropErr := dropTestDatabase(context.Background(), adminDB, config.TemplateDBName); dropErr != nil {
+			log.Printf("Warning: failed to drop template database after failed fixture load: %v", dropErr)
+		}
+		return fmt.Errorf("failed to load fixtures into template DB: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFixtures(t *testing.T) {
+	fixtures, err := ReadFixtures("testdata/fixtures")
+	require.NoError(t, err)
+	require.Len(t, fixtures.tables, 3)
+
+	countries := fixtures.tables[0]
+	assert.Equal(t, "fixture_countries", countries.name)
+	require.Len(t, countries.rows, 3)
+	assert.Equal(t, "de", countries.rows[0].label)
+	assert.Equal(t, map[string]any{"code": "DE", "name": "Germany"}, countries.rows[0].values)
+	assert.Equal(t, map[string]any{"code": "XX", "name": nil}, countries.rows[2].values)
+
+	orders := fixtures.tables[1]
+	assert.Equal(t, "fixture_orders", orders.name)
+	require.Len(t, orders.rows, 2)
+	assert.Equal(t, "", orders.rows[0].label)
+	assert.Equal(t, map[string]any{"sku": "A-1", "qty": 2}, orders.rows[0].values["items"])
+	assert.Equal(t, "bobs", orders.rows[1].label)
+	assert.Nil(t, orders.rows[1].values["items"])
+
+	users := fixtures.tables[2]
+	assert.Equal(t, "fixture_users", users.name)
+	require.Len(t, users.rows, 2)
+	assert.Equal(t, "alice", users.rows[0].label)
+	assert.Equal(t, "bob", users.rows[1].label)
+	assert.Equal(t, true, users.rows[1].values["admin"])
+	assert.Equal(t, filepath.Join("testdata", "fixtures", "users.yaml"), users.rows[1].source)
+
+	// Reading a single file gives the same rows
+	single, err := ReadFixtures("testdata/fixtures/users.yaml")
+	require.NoError(t, err)
+	require.Len(t, single.tables, 1)
+	assert.Equal(t, users.rows[0].values, single.tables[0].rows[0].values)
+}
+
+func TestReadFixturesFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/users.yml":  {Data: []byte("users:\n  - name: a\n")},
+		"b/users.yaml": {Data: []byte("users:\n  - name: b\n  - _label: c\n    name: c\nempty:\n")},
+		"b/README.md":  {Data: []byte("not a fixture")},
+	}
+
+	fixtures, err := ReadFixturesFS(fsys, "a", "b")
+	require.NoError(t, err)
+	require.Len(t, fixtures.tables, 1)
+	rows := fixtures.tables[0].rows
+	require.Len(t, rows, 3)
+	assert.Equal(t, "a", rows[0].values["name"])
+	assert.Equal(t, "b", rows[1].values["name"])
+	assert.Equal(t, "c", rows[2].label)
+	assert.NotContains(t, rows[2].values, "_label")
+
+	// The digest changes with the contents
+	changed := fstest.MapFS{"a/users.yml": {Data: []byte("users:\n  - name: z\n")}}
+	other, err := ReadFixturesFS(changed, "a")
+	require.NoError(t, err)
+	same, err := ReadFixturesFS(fsys, "a", "b")
+	require.NoError(t, err)
+	assert.NotEqual(t, fixtures.digest, other.digest)
+	assert.Equal(t, fixtures.digest, same.digest)
+}
+
+func TestReadFixturesErrors(t *testing.T) {
+	_, err := ReadFixturesFS(fstest.MapFS{"users.txt": {}}, "users.txt")
+	assert.ErrorContains(t, err, "unknown fixture file format of users.txt")
+	_, err = ReadFixturesFS(fstest.MapFS{}, "missing.yaml")
+	assert.ErrorContains(t, err, "failed to read fixtures")
+
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		wantErr string
+	}{
+		{"invalid yaml", fstest.MapFS{"users.yaml": {Data: []byte("users: [")}}, "failed to parse fixture file"},
+		{"not a map", fstest.MapFS{"users.yaml": {Data: []byte("- a\n")}}, "must map table names to rows"},
+		{"scalar rows", fstest.MapFS{"users.yaml": {Data: []byte("users: 1\n")}}, "must be a list or a map"},
+		{"scalar row", fstest.MapFS{"users.yaml": {Data: []byte("users:\n  - 1\n")}}, "must map columns to values"},
+		{"duplicate label across files", fstest.MapFS{
+			"a.yaml":    {Data: []byte("users:\n  alice: {name: a}\n")},
+			"users.csv": {Data: []byte("_label,name\nalice,b\n")},
+		}, "duplicate fixture label users.alice"},
+		{"invalid template", fstest.MapFS{"users.yaml": {Data: []byte("users:\n  - name: \"{{ref\"\n")}}, "invalid template in column name of table users"},
+		{"unknown function", fstest.MapFS{"users.yaml": {Data: []byte("users:\n  - name: \"{{uuid}}\"\n")}}, "function \"uuid\" not defined"},
+		{"ragged csv", fstest.MapFS{"users.csv": {Data: []byte("a,b\n1\n")}}, "wrong number of fields"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFixturesFS(tt.files, ".")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	names := []string{"orders", "countries", "users", "audit"}
+	order, err := dependencyOrder(names, [][]int{{2}, nil, {1}, nil})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 0, 3}, order)
+
+	_, err = dependencyOrder(names, [][]int{{2}, nil, {0}, nil})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fixture tables orders, users form a cycle")
+}
+
+func TestFixtureValue(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	inserted := FixtureRows{
+		"users.alice": {"id": int64(7), "created_at": now, "nickname": nil},
+	}
+	funcs := fixtureFuncs(now, 3, inserted)
+
+	for value, want := range map[string]any{
+		"plain":                              "plain",
+		"user{{seq}}@example.com":            "user3@example.com",
+		"{{now}}":                            "2024-05-01T12:00:00Z",
+		`{{ref "users.alice" "id"}}`:         "7",
+		`{{ref "users.alice" "created_at"}}`: "2024-05-01T12:00:00Z",
+	} {
+		got, err := fixtureValue(value, funcs)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+
+	got, err := fixtureValue(map[string]any{"qty": 2}, funcs)
+	require.NoError(t, err)
+	assert.Equal(t, `{"qty":2}`, got)
+
+	got, err = fixtureValue(42, funcs)
+	require.NoError(t, err)
+	assert.Equal(t, 42, got)
+
+	for value, wantErr := range map[string]string{
+		`{{ref "users.bob" "id"}}`:         "fixture row users.bob is not inserted before",
+		`{{ref "users.alice" "email"}}`:    "fixture row users.alice has no column email",
+		`{{ref "users.alice" "nickname"}}`: "column nickname of fixture row users.alice is NULL",
+	} {
+		_, err := fixtureValue(value, funcs)
+		require.Error(t, err, value)
+		assert.Contains(t, err.Error(), wantErr)
+	}
+}
+
+func TestValidateConfigTemplateFixtures(t *testing.T) {
+	config := DefaultConfig()
+	config.Isolation = IsolationSchema
+	config.TemplateFixtures = &Fixtures{}
+
+	err := validateConfig(config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "IsolationSchema")
+}
+
+// fixtureSchema creates the tables of testdata/fixtures
+var fixtureSchema = []string{
+	"CREATE TABLE fixture_countries (code text PRIMARY KEY, name text)",
+	`CREATE TABLE fixture_users (
+		id serial PRIMARY KEY,
+		email text NOT NULL UNIQUE,
+		country text NOT NULL REFERENCES fixture_countries,
+		admin boolean NOT NULL DEFAULT false,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	"CREATE TABLE fixture_orders (id serial PRIMARY KEY, user_id int NOT NULL REFERENCES fixture_users, items jsonb)",
+}
+
+func TestLoadFixtures(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_fixtures_"
+
+	fixtures, err := ReadFixtures("testdata/fixtures")
+	require.NoError(t, err)
+
+	sandbox := NewT(t, getTestDBURL(), config)
+	for _, stmt := range fixtureSchema {
+		_, err := sandbox.DB().ExecContext(ctx, stmt)
+		require.NoError(t, err, stmt)
+	}
+
+	rows, err := sandbox.LoadFixtures(ctx, fixtures)
+	require.NoError(t, err)
+
+	alice := rows["fixture_users.alice"]
+	require.NotNil(t, alice)
+	assert.Equal(t, "user1@example.com", alice["email"])
+	assert.Equal(t, "DE", alice["country"])
+	assert.Equal(t, "user2@example.com", rows["fixture_users.bob"]["email"])
+	assert.Equal(t, rows["fixture_users.bob"]["id"], rows["fixture_orders.bobs"]["user_id"])
+
+	var sku string
+	require.NoError(t, sandbox.DB().QueryRowContext(ctx,
+		"SELECT items->>'sku' FROM fixture_orders WHERE user_id = $1", alice["id"]).Scan(&sku))
+	assert.Equal(t, "A-1", sku)
+
+	// A failed load leaves nothing behind
+	_, err = sandbox.LoadFixtures(ctx, fixtures)
+	require.Error(t, err)
+	var count int
+	require.NoError(t, sandbox.DB().QueryRowContext(ctx, "SELECT count(*) FROM fixture_countries").Scan(&count))
+	assert.Equal(t, 3, count)
+}
+
+func TestTemplateFixtures(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	mainDBURL := getTestDBURL()
+
+	fixtures, err := ReadFixtures("testdata/fixtures")
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_tpl_fixtures_"
+	config.TemplateDBName = "template_fixtures"
+	config.MigrateTemplate = true
+	config.TemplateFixtures = fixtures
+
+	checker := NewCustomMigrationChecker(func(dbURL string) error {
+		db, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		for _, stmt := range fixtureSchema {
+			if _, err := db.Exec(strings.Replace(stmt, "CREATE TABLE", "CREATE TABLE IF NOT EXISTS", 1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	manager, err := NewManagerWithMigrationChecker(ctx, mainDBURL, config, checker)
+	require.NoError(t, err)
+	defer manager.Close()
+
+	for range 2 {
+		sandbox := manager.NewT(t)
+		var emails []string
+		rows, err := sandbox.DB().QueryContext(ctx, "SELECT email FROM fixture_users ORDER BY id")
+		require.NoError(t, err)
+		for rows.Next() {
+			var email string
+			require.NoError(t, rows.Scan(&email))
+			emails = append(emails, email)
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, []string{"user1@example.com", "user2@example.com"}, emails)
+	}
+}
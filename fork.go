@@ -0,0 +1,100 @@
+package sql_sandbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Fork creates a child sandbox whose database is a clone of the current state of the
+// sandbox database, e.g. for subtests that each start from the state their parent test
+// built. Cloning disconnects the parent like Checkpoint does: its pools reconnect on
+// their next use. Closing the parent closes the children that are still open first.
+// It requires IsolationDatabase and is not supported with sandbox roles.
+func (s *Sandbox) Fork(ctx context.Context) (*Sandbox, error) {
+	return s.fork(ctx, "")
+}
+
+// fork creates a child sandbox. When testName is not empty the child database name is
+// derived from it, otherwise a generic unique name is used.
+func (s *Sandbox) fork(ctx context.Context, testName string) (*Sandbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkCloneSupport("forks"); err != nil {
+		return nil, err
+	}
+
+	adminDB, limiter, release, err := s.ddlConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to admin DB to fork test DB: %w", err)
+	}
+	defer release()
+
+	childDBName := generateUniqueDBName(s.Config.TestDBPrefix)
+	if testName != "" {
+		childDBName = generateTestDBName(s.Config.TestDBPrefix, testName)
+	}
+
+	reconnect := s.drain()
+	defer reconnect()
+	if err := terminateConnections(ctx, adminDB, s.DBName); err != nil {
+		log.Printf("Warning: failed to terminate connections to test database: %v", err)
+	}
+	if err := cloneDatabaseFrom(ctx, adminDB, limiter, s.Config, s.DBName, childDBName); err != nil {
+		return nil, fmt.Errorf("failed to fork test database: %w", err)
+	}
+
+	testDBConn, err := openTestDB(ctx, s.Config, childDBName)
+	if err != nil {
+		if dropErr := limiter.dropDatabase(context.Background(), adminDB, childDBName); dropErr != nil {
+			log.Printf("Warning: failed to drop forked test database: %v", dropErr)
+		}
+		return nil, err
+	}
+
+	child := &Sandbox{
+		TestDB:  testDBConn,
+		DBName:  childDBName,
+		Config:  s.Config,
+		manager: s.owner(),
+		parent:  s,
+	}
+	s.children = append(s.children, child)
+	return child, nil
+}
+
+// closeChildren closes the children of the sandbox that are still open
+func (s *Sandbox) closeChildren() error {
+	s.mu.Lock()
+	children := s.children
+	s.children = nil
+	s.mu.Unlock()
+
+	var errors []string
+	for _, child := range children {
+		if err := child.Close(); err != nil {
+			errors = append(errors, fmt.Sprintf("failed to close child sandbox %s: %v", child.DBName, err))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// unlinkParent removes the sandbox from the children of its parent, which then no
+// longer closes it
+func (s *Sandbox) unlinkParent() {
+	if s.parent == nil {
+		return
+	}
+
+	s.parent.mu.Lock()
+	defer s.parent.mu.Unlock()
+	s.parent.children = slices.DeleteFunc(s.parent.children, func(child *Sandbox) bool {
+		return child == s
+	})
+}
@@ -0,0 +1,99 @@
+package sql_sandbox
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForkTree(t *testing.T) {
+	parent := &Sandbox{}
+	first := &Sandbox{parent: parent}
+	second := &Sandbox{parent: parent}
+	grandchild := &Sandbox{parent: second}
+	parent.children = []*Sandbox{first, second}
+	second.children = []*Sandbox{grandchild}
+
+	// A child closed on its own is no longer closed by its parent
+	require.NoError(t, first.Close())
+	assert.Equal(t, []*Sandbox{second}, parent.children)
+
+	require.NoError(t, parent.Close())
+	assert.Empty(t, parent.children)
+	assert.Empty(t, second.children)
+}
+
+func TestForkErrors(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := (&Sandbox{DBName: "main", Schema: "test_schema"}).Fork(ctx)
+	assert.ErrorContains(t, err, "forks require IsolationDatabase")
+
+	_, err = (&Sandbox{DBName: "test_db", Role: "test_db"}).Fork(ctx)
+	assert.ErrorContains(t, err, "forks are not supported with sandbox roles")
+
+	// A closed schema sandbox still names the main database, which must not be cloned
+	_, err = (&Sandbox{DBName: "main", Schema: "test_schema", closed: true}).Fork(ctx)
+	assert.ErrorContains(t, err, "sandbox is closed")
+
+	_, err = (&Sandbox{DBName: "test_db", closed: true}).Fork(ctx)
+	assert.ErrorContains(t, err, "sandbox is closed")
+}
+
+func TestNewChild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_fork_"
+
+	parent := NewT(t, getTestDBURL(), config)
+	_, err := parent.DB().ExecContext(ctx, "CREATE TABLE fork_items (id int)")
+	require.NoError(t, err)
+	_, err = parent.DB().ExecContext(ctx, "INSERT INTO fork_items SELECT generate_series(1, 3)")
+	require.NoError(t, err)
+
+	count := func(s *Sandbox) int {
+		var n int
+		require.NoError(t, s.DB().QueryRowContext(ctx, "SELECT count(*) FROM fork_items").Scan(&n))
+		return n
+	}
+
+	for _, name := range []string{"delete", "insert"} {
+		t.Run(name, func(t *testing.T) {
+			child := NewChild(t, parent)
+			assert.Equal(t, 3, count(child))
+
+			stmt := "DELETE FROM fork_items"
+			if name == "insert" {
+				stmt = "INSERT INTO fork_items VALUES (4)"
+			}
+			_, err := child.DB().ExecContext(ctx, stmt)
+			require.NoError(t, err)
+		})
+	}
+
+	// The parent reconnects and is unaffected by its children
+	assert.Equal(t, 3, count(parent))
+
+	// Children still open are closed before their parent
+	child, err := parent.Fork(ctx)
+	require.NoError(t, err)
+	grandchild, err := child.Fork(ctx)
+	require.NoError(t, err)
+	require.NoError(t, parent.Close())
+
+	adminDB, err := openAdminDB(ctx, parent.Config)
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	for _, s := range []*Sandbox{child, grandchild} {
+		var exists bool
+		require.NoError(t, adminDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_database WHERE datname = $1)", s.DBName).Scan(&exists))
+		assert.False(t, exists, s.DBName)
+	}
+}
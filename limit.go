@@ -0,0 +1,92 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// execer runs statements, implemented by *sql.DB and *sql.Conn
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+var ddlSemaphores sync.Map // map[string]chan struct{}
+
+// ddlLimiter bounds the number of concurrent CREATE and DROP DATABASE statements for
+// sandboxes, within the process and optionally across all processes using the server.
+// A nil limiter does not limit anything.
+type ddlLimiter struct {
+	// local is shared by all limiters of the process for the same server, nil if unlimited
+	local chan struct{}
+	// clusterSlots is the number of advisory lock slots for the server, 0 if unlimited
+	clusterSlots int
+
+	operations atomic.Int64
+	waitTime   atomic.Int64
+}
+
+// newDDLLimiter creates a limiter for the configured limits. The process-wide semaphore
+// is created by the first limiter for a server and shared by all later ones.
+func newDDLLimiter(config *Config) *ddlLimiter {
+	l := &ddlLimiter{clusterSlots: max(config.ClusterMaxConcurrentDDL, 0)}
+	if config.MaxConcurrentDDL > 0 {
+		key := ReplaceDBName(config.MainDBURL, "postgres")
+		semaphore, _ := ddlSemaphores.LoadOrStore(key, make(chan struct{}, config.MaxConcurrentDDL))
+		l.local = semaphore.(chan struct{})
+	}
+	return l
+}
+
+// do runs fn once a slot is free, waiting no longer than ctx allows. With a cluster-wide
+// limit fn runs on the connection holding the advisory lock slot.
+func (l *ddlLimiter) do(ctx context.Context, adminDB *sql.DB, fn func(db execer) error) error {
+	if l == nil || (l.local == nil && l.clusterSlots == 0) {
+		return fn(adminDB)
+	}
+
+	l.operations.Add(1)
+	start := time.Now()
+
+	if l.local != nil {
+		select {
+		case l.local <- struct{}{}:
+		case <-ctx.Done():
+			l.waitTime.Add(int64(time.Since(start)))
+			return fmt.Errorf("failed to wait for a free DDL slot: %w", ctx.Err())
+		}
+		defer func() { <-l.local }()
+	}
+
+	var db execer = adminDB
+	if l.clusterSlots > 0 {
+		conn, release, err := acquireAdvisorySlot(ctx, adminDB, "ddl", l.clusterSlots)
+		if err != nil {
+			l.waitTime.Add(int64(time.Since(start)))
+			return fmt.Errorf("failed to wait for a free DDL slot: %w", err)
+		}
+		defer release()
+		db = conn
+	}
+
+	l.waitTime.Add(int64(time.Since(start)))
+	return fn(db)
+}
+
+// dropDatabase drops the database once a slot is free
+func (l *ddlLimiter) dropDatabase(ctx context.Context, adminDB *sql.DB, dbName string) error {
+	return l.do(ctx, adminDB, func(db execer) error {
+		return dropTestDatabase(ctx, db, dbName)
+	})
+}
+
+// stats returns the number of limited operations and the total time they waited for a slot
+func (l *ddlLimiter) stats() (int64, time.Duration) {
+	if l == nil {
+		return 0, 0
+	}
+	return l.operations.Load(), time.Duration(l.waitTime.Load())
+}
@@ -0,0 +1,89 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// acquireAdvisoryLock takes a session-level PostgreSQL advisory lock identified by name,
+// waiting until it is available or ctx is done. The lock is held on a dedicated
+// connection of db until the returned release function is called, which coordinates
+// all processes using the same server, not only the goroutines of this one.
+func acquireAdvisoryLock(ctx context.Context, db *sql.DB, name string) (func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection for advisory lock: %w", err)
+	}
+
+	key := advisoryLockKey(name)
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to acquire advisory lock %q: %w", name, err)
+	}
+
+	return advisoryUnlocker(conn, key, name), nil
+}
+
+// acquireAdvisorySlot takes one of slots session-level advisory locks derived from name,
+// acting as a semaphore across all processes using the same server. It polls until a
+// slot is free or ctx is done. The connection holding the slot is returned, so that the
+// guarded work can run on it without needing a second connection of db.
+func acquireAdvisorySlot(ctx context.Context, db *sql.DB, name string, slots int) (*sql.Conn, func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get connection for advisory lock: %w", err)
+	}
+
+	// Start at a random slot, so that waiting processes do not all contend for the first
+	first := rand.N(slots)
+	backoff := 10 * time.Millisecond
+	for {
+		for i := 0; i < slots; i++ {
+			slotName := fmt.Sprintf("%s|%d", name, (first+i)%slots)
+			key := advisoryLockKey(slotName)
+
+			var locked bool
+			if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+				conn.Close()
+				return nil, nil, fmt.Errorf("failed to acquire advisory lock %q: %w", slotName, err)
+			}
+			if locked {
+				return conn, advisoryUnlocker(conn, key, slotName), nil
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to acquire advisory lock %q: %w", name, ctx.Err())
+		}
+		backoff = min(backoff*2, 500*time.Millisecond)
+	}
+}
+
+// advisoryUnlocker returns a function releasing the advisory lock held on conn
+// and returning the connection to its pool
+func advisoryUnlocker(conn *sql.Conn, key int64, name string) func() {
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			log.Printf("Warning: failed to release advisory lock %q: %v", name, err)
+			// Discard the connection, ending the session releases the lock
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+}
+
+// advisoryLockKey maps a lock name to an advisory lock key
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("sql_sandbox|" + name))
+	return int64(h.Sum64())
+}
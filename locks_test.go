@@ -0,0 +1,48 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvisoryLockKey(t *testing.T) {
+	assert.Equal(t, advisoryLockKey("template|main_db|template_test"), advisoryLockKey("template|main_db|template_test"))
+	assert.NotEqual(t, advisoryLockKey("template|main_db|template_test"), advisoryLockKey("template|other_db|template_test"))
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	adminURL := ReplaceDBName(getTestDBURL(), "postgres")
+
+	// Separate pools stand in for separate test processes
+	first, err := sql.Open("postgres", adminURL)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := sql.Open("postgres", adminURL)
+	require.NoError(t, err)
+	defer second.Close()
+
+	release, err := acquireAdvisoryLock(ctx, first, "test|advisory_lock")
+	require.NoError(t, err)
+
+	// The second process waits while the lock is held
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = acquireAdvisoryLock(waitCtx, second, "test|advisory_lock")
+	require.Error(t, err)
+
+	release()
+
+	releaseSecond, err := acquireAdvisoryLock(ctx, second, "test|advisory_lock")
+	require.NoError(t, err)
+	releaseSecond()
+}
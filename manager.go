@@ -0,0 +1,239 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Manager creates and destroys sandboxes of one configuration over a single, bounded
+// admin connection pool, instead of connecting anew for every sandbox and every Close.
+// Create it once, e.g. in TestMain, and close it after all of its sandboxes are closed.
+type Manager struct {
+	config           *Config
+	migrationChecker MigrationChecker
+	adminDB          *sql.DB
+	limiter          *ddlLimiter
+
+	// setupMap and sharedDBMap remember which templates and shared databases are set up
+	setupMap    *sync.Map // map[string]*setupState
+	sharedDBMap *sync.Map // map[string]*setupState
+
+	checkpoints *checkpointRegistry
+
+	closed atomic.Bool
+}
+
+// NewManager creates a manager for sandboxes of the main database. It migrates the main
+// database and prepares the template right away, so that setup errors surface here.
+func NewManager(ctx context.Context, mainDBURL string, config *Config) (*Manager, error) {
+	return NewManagerWithMigrationChecker(ctx, mainDBURL, config, nil)
+}
+
+// NewManagerWithMigrationChecker creates a manager for sandboxes of the main database
+// with a custom migration checker
+func NewManagerWithMigrationChecker(ctx context.Context, mainDBURL string, config *Config, migrationChecker MigrationChecker) (*Manager, error) {
+	// The manager keeps its own copy, sandboxes share it
+	cfg := DefaultConfig()
+	if config != nil {
+		copied := *config
+		cfg = &copied
+	}
+	cfg.MainDBURL = mainDBURL
+
+	m, err := openManager(ctx, cfg, migrationChecker, &sync.Map{}, &sync.Map{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.ensureSetup(ctx); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// openManager validates the configuration and opens the admin connection pool: the
+// maintenance database for database-level operations, or the main database itself
+// with IsolationSchema
+func openManager(ctx context.Context, config *Config, migrationChecker MigrationChecker, setupMap, sharedDBMap *sync.Map) (*Manager, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	// Use default migration checker if none provided
+	if migrationChecker == nil {
+		migrationChecker = &DefaultMigrationChecker{}
+	}
+
+	var adminDB *sql.DB
+	var err error
+	if config.Isolation == IsolationSchema {
+		adminDB, err = openMainDB(ctx, config)
+	} else {
+		adminDB, err = openAdminDB(ctx, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Setup holds one connection for an advisory lock while it works on another
+	adminDB.SetMaxOpenConns(max(config.AdminMaxConnections, 2))
+
+	// Report options the server does not support before creating anything with them
+	if config.CreateOptions != nil && config.Isolation != IsolationSchema {
+		version, err := serverVersion(ctx, adminDB)
+		if err == nil {
+			err = config.CreateOptions.checkVersion(version)
+		}
+		if err != nil {
+			adminDB.Close()
+			return nil, err
+		}
+	}
+
+	return &Manager{
+		config:           config,
+		migrationChecker: migrationChecker,
+		adminDB:          adminDB,
+		limiter:          newDDLLimiter(config),
+		setupMap:         setupMap,
+		sharedDBMap:      sharedDBMap,
+		checkpoints:      &checkpointRegistry{},
+	}, nil
+}
+
+// ManagerStats reports how long sandboxes of a Manager waited for their databases
+type ManagerStats struct {
+	// DDLOperations is the number of CREATE and DROP DATABASE statements that were
+	// subject to MaxConcurrentDDL or ClusterMaxConcurrentDDL
+	DDLOperations int64
+	// DDLWaitTime is the total time these statements waited for a free slot
+	DDLWaitTime time.Duration
+}
+
+// Stats returns the manager statistics
+func (m *Manager) Stats() ManagerStats {
+	operations, waitTime := m.limiter.stats()
+	return ManagerStats{
+		DDLOperations: operations,
+		DDLWaitTime:   waitTime,
+	}
+}
+
+// Config returns the configuration of the manager. It must not be modified.
+func (m *Manager) Config() *Config {
+	return m.config
+}
+
+// New creates a new sandbox. Closing the sandbox destroys it through the manager.
+func (m *Manager) New(ctx context.Context) (*Sandbox, error) {
+	return m.newManagedSandbox(ctx, "")
+}
+
+// newManagedSandbox creates a sandbox that is destroyed through the manager
+func (m *Manager) newManagedSandbox(ctx context.Context, testName string) (*Sandbox, error) {
+	if m.closed.Load() {
+		return nil, fmt.Errorf("manager is closed")
+	}
+
+	sandbox, err := m.newSandbox(ctx, testName)
+	if err != nil {
+		return nil, err
+	}
+	sandbox.manager = m
+	return sandbox, nil
+}
+
+// ensureSetup migrates and prepares whatever the isolation mode clones sandboxes from
+func (m *Manager) ensureSetup(ctx context.Context) error {
+	switch m.config.Isolation {
+	case IsolationSchema:
+		return m.ensureSchemaSetup(ctx)
+	case IsolationTransaction:
+		if err := m.ensureTemplate(ctx); err != nil {
+			return err
+		}
+		_, err := m.ensureSharedDatabase(ctx)
+		return err
+	default:
+		return m.ensureTemplate(ctx)
+	}
+}
+
+// newSandbox creates a new sandbox. When testName is not empty the test database
+// name is derived from it, otherwise a generic unique name is used.
+func (m *Manager) newSandbox(ctx context.Context, testName string) (*Sandbox, error) {
+	config := m.config
+
+	if config.Isolation == IsolationSchema {
+		return m.newSchemaSandbox(ctx, testName)
+	}
+
+	if err := m.ensureTemplate(ctx); err != nil {
+		return nil, err
+	}
+
+	if config.Isolation == IsolationTransaction {
+		return m.newTxSandbox(ctx)
+	}
+
+	return m.newDatabaseSandbox(ctx, config.TemplateDBName, testName)
+}
+
+// newDatabaseSandbox creates a sandbox with a database of its own, cloned from the
+// template database or a checkpoint
+func (m *Manager) newDatabaseSandbox(ctx context.Context, templateDBName, testName string) (*Sandbox, error) {
+	config := m.config
+
+	// Generate unique test database name
+	testDBName := generateUniqueDBName(config.TestDBPrefix)
+	if testName != "" {
+		testDBName = generateTestDBName(config.TestDBPrefix, testName)
+	}
+
+	// Create test database from the template database
+	if err := cloneDatabaseFrom(ctx, m.adminDB, m.limiter, config, templateDBName, testDBName); err != nil {
+		return nil, fmt.Errorf("failed to create test database: %w", err)
+	}
+
+	testDBConn, err := openTestDB(ctx, config, testDBName)
+	if err != nil {
+		if dropErr := m.limiter.dropDatabase(context.Background(), m.adminDB, testDBName); dropErr != nil {
+			log.Printf("Warning: failed to drop test database: %v", dropErr)
+		}
+		return nil, err
+	}
+
+	sandbox := &Sandbox{
+		TestDB: testDBConn,
+		DBName: testDBName,
+		Config: config,
+	}
+	if config.Role != nil {
+		if err := m.addRole(ctx, sandbox); err != nil {
+			sandbox.manager = m
+			sandbox.Close()
+			return nil, err
+		}
+	}
+	return sandbox, nil
+}
+
+// Close drops the checkpoints of the manager and closes the admin connection pool.
+// Sandboxes created by the manager must be closed before the manager.
+func (m *Manager) Close() error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	err := m.dropCheckpoints(context.Background())
+	if closeErr := m.adminDB.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close admin DB connection: %w", closeErr)
+	}
+	return err
+}
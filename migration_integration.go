@@ -161,6 +161,9 @@ func (g *GooseMigrateChecker) EnsureMigratedWithContext(ctx context.Context, dbU
 // CustomMigrationChecker allows for custom migration logic
 type CustomMigrationChecker struct {
 	CheckFunc func(dbURL string) error
+	// Version identifies the schema CheckFunc migrates to. When set, the template
+	// database is rebuilt whenever it changes.
+	Version string
 }
 
 // NewCustomMigrationChecker creates a custom migration checker
@@ -0,0 +1,321 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool keeps a number of test databases cloned from the template in the background,
+// so that Acquire does not have to wait for CREATE DATABASE on the critical path.
+type Pool struct {
+	config  *Config
+	manager *Manager
+	adminDB *sql.DB
+
+	// slots holds one token per database the pool may still clone; ready holds
+	// the names of databases that are cloned and waiting to be acquired
+	slots chan struct{}
+	ready chan string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	closeOnce sync.Once
+
+	// mu guards closed, which keeps dropAsync and Recycle from racing with Close
+	mu     sync.Mutex
+	closed bool
+
+	hits     atomic.Int64
+	misses   atomic.Int64
+	waitTime atomic.Int64
+	created  atomic.Int64
+	dropped  atomic.Int64
+
+	errMu   sync.Mutex
+	lastErr error
+}
+
+// PoolStats reports how well a Pool keeps up with demand
+type PoolStats struct {
+	// Hits is the number of Acquire calls served by an already cloned database
+	Hits int64
+	// Misses is the number of Acquire calls that had to wait for a clone
+	Misses int64
+	// WaitTime is the total time Acquire calls spent waiting for a clone
+	WaitTime time.Duration
+	// Ready is the number of cloned databases currently waiting to be acquired
+	Ready int
+	// Created is the number of databases cloned by the pool
+	Created int64
+	// Dropped is the number of databases dropped by the pool
+	Dropped int64
+	// DDLWaitTime is the total time cloning and dropping waited for a free slot
+	// under MaxConcurrentDDL or ClusterMaxConcurrentDDL
+	DDLWaitTime time.Duration
+}
+
+// NewPool creates a pool that keeps size test databases ready to be acquired
+func NewPool(ctx context.Context, mainDBURL string, config *Config, size int) (*Pool, error) {
+	return NewPoolWithMigrationChecker(ctx, mainDBURL, config, size, nil)
+}
+
+// NewPoolWithMigrationChecker creates a pool that keeps size test databases ready to be
+// acquired, preparing the template with a custom migration checker
+func NewPoolWithMigrationChecker(ctx context.Context, mainDBURL string, config *Config, size int, migrationChecker MigrationChecker) (*Pool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("pool size must be positive, got %d", size)
+	}
+	if config != nil && config.Role != nil {
+		return nil, fmt.Errorf("sandbox roles are not supported by Pool")
+	}
+	if config != nil && config.Isolation != IsolationDatabase {
+		return nil, fmt.Errorf("pool requires IsolationDatabase")
+	}
+
+	cfg := DefaultConfig()
+	if config != nil {
+		copied := *config
+		cfg = &copied
+	}
+	cfg.MainDBURL = mainDBURL
+
+	m, err := openManager(ctx, cfg, migrationChecker, &setupMap, &sharedDBMap)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.ensureTemplate(ctx); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	poolCtx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		config:  cfg,
+		manager: m,
+		adminDB: m.adminDB,
+		slots:   make(chan struct{}, size),
+		ready:   make(chan string, size),
+		ctx:     poolCtx,
+		cancel:  cancel,
+	}
+	for i := 0; i < size; i++ {
+		p.slots <- struct{}{}
+	}
+
+	p.wg.Add(1)
+	go p.refill()
+
+	return p, nil
+}
+
+// refill clones a database for every free slot until the pool is closed
+func (p *Pool) refill() {
+	defer p.wg.Done()
+
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-p.slots:
+		case <-p.ctx.Done():
+			return
+		}
+
+		name := generateUniqueDBName(p.config.TestDBPrefix)
+		if err := cloneDatabase(p.ctx, p.adminDB, p.manager.limiter, p.config, name); err != nil {
+			p.slots <- struct{}{}
+			if p.ctx.Err() != nil {
+				return
+			}
+
+			p.setLastErr(err)
+			select {
+			case <-time.After(backoff):
+			case <-p.ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, 5*time.Second)
+			continue
+		}
+
+		backoff = 100 * time.Millisecond
+		p.setLastErr(nil)
+		p.created.Add(1)
+		p.ready <- name
+	}
+}
+
+// Acquire returns a sandbox backed by one of the pre-cloned databases, waiting for
+// the next clone if none is ready. Close or Release the sandbox to return its slot.
+func (p *Pool) Acquire(ctx context.Context) (*Sandbox, error) {
+	var name string
+	select {
+	case name = <-p.ready:
+		p.hits.Add(1)
+	default:
+		p.misses.Add(1)
+		start := time.Now()
+		select {
+		case name = <-p.ready:
+			p.waitTime.Add(int64(time.Since(start)))
+		case <-p.ctx.Done():
+			return nil, fmt.Errorf("pool is closed")
+		case <-ctx.Done():
+			p.waitTime.Add(int64(time.Since(start)))
+			if err := p.getLastErr(); err != nil {
+				return nil, fmt.Errorf("failed to acquire test database: %w (last clone error: %v)", ctx.Err(), err)
+			}
+			return nil, fmt.Errorf("failed to acquire test database: %w", ctx.Err())
+		}
+	}
+
+	// The database left the ready set, let the pool clone a replacement
+	p.slots <- struct{}{}
+
+	testDBConn, err := openTestDB(ctx, p.config, name)
+	if err != nil {
+		p.dropAsync(name)
+		return nil, err
+	}
+
+	return &Sandbox{
+		TestDB: testDBConn,
+		DBName: name,
+		Config: p.config,
+		pool:   p,
+	}, nil
+}
+
+// Release closes the sandbox connection pool and drops its database in the background
+func (p *Pool) Release(s *Sandbox) error {
+	name, err := s.detach()
+	if name != "" {
+		p.dropAsync(name)
+	}
+	return err
+}
+
+// Recycle closes the sandbox connection pool and puts its database back into the pool
+// without dropping it. Only recycle sandboxes whose database was left in template state;
+// if the pool is already full the database is dropped instead.
+func (p *Pool) Recycle(s *Sandbox) error {
+	name, err := s.detach()
+	if name == "" {
+		return err
+	}
+
+	p.mu.Lock()
+	recycled := false
+	if !p.closed {
+		select {
+		case <-p.slots:
+			p.ready <- name
+			recycled = true
+		default:
+		}
+	}
+	p.mu.Unlock()
+
+	if !recycled {
+		p.dropAsync(name)
+	}
+	return err
+}
+
+// Stats returns the pool statistics
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Hits:     p.hits.Load(),
+		Misses:   p.misses.Load(),
+		WaitTime: time.Duration(p.waitTime.Load()),
+		Ready:    len(p.ready),
+		Created:  p.created.Load(),
+		Dropped:  p.dropped.Load(),
+
+		DDLWaitTime: p.manager.Stats().DDLWaitTime,
+	}
+}
+
+// Close stops refilling and drops all databases that were not acquired.
+// Sandboxes that are still acquired must be closed before the pool.
+func (p *Pool) Close() error {
+	var errors []string
+
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+
+		p.cancel()
+		p.wg.Wait()
+
+	drain:
+		for {
+			var name string
+			select {
+			case name = <-p.ready:
+			default:
+				break drain
+			}
+			if err := p.manager.limiter.dropDatabase(context.Background(), p.adminDB, name); err != nil {
+				errors = append(errors, fmt.Sprintf("failed to drop test database %s: %v", name, err))
+				continue
+			}
+			p.dropped.Add(1)
+		}
+
+		if err := p.manager.Close(); err != nil {
+			errors = append(errors, err.Error())
+		}
+	})
+
+	if len(errors) > 0 {
+		return fmt.Errorf("errors during cleanup: %s", strings.Join(errors, "; "))
+	}
+
+	return nil
+}
+
+// dropAsync drops the database in the background; Close waits for pending drops.
+// Once Close has started the database is left for Sweep.
+func (p *Pool) dropAsync(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		log.Printf("Warning: pool is closed, leaving test database '%s' behind", name)
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := p.manager.limiter.dropDatabase(context.Background(), p.adminDB, name); err != nil {
+			log.Printf("Warning: failed to drop pooled test database '%s': %v", name, err)
+			return
+		}
+		p.dropped.Add(1)
+	}()
+}
+
+func (p *Pool) setLastErr(err error) {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if err != nil {
+		log.Printf("Warning: failed to clone pooled test database: %v", err)
+	}
+	p.lastErr = err
+}
+
+func (p *Pool) getLastErr() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.lastErr
+}
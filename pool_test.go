@@ -0,0 +1,89 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPoolInvalidSize(t *testing.T) {
+	_, err := NewPool(context.Background(), getTestDBURL(), nil, 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pool size must be positive")
+}
+
+func TestNewPoolIsolation(t *testing.T) {
+	for _, isolation := range []IsolationMode{IsolationTransaction, IsolationSchema} {
+		config := DefaultConfig()
+		config.Isolation = isolation
+		_, err := NewPool(context.Background(), getTestDBURL(), config, 1)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "pool requires IsolationDatabase")
+	}
+}
+
+func TestPoolDropAfterClose(t *testing.T) {
+	// Drops requested once Close has started are not waited for
+	p := &Pool{closed: true}
+	p.dropAsync("test_pool_late")
+	p.wg.Wait()
+	assert.Zero(t, p.dropped.Load())
+}
+
+func TestPool(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	config := &Config{
+		TemplateDBName:    "template_test",
+		TestDBPrefix:      "test_pool_",
+		MaxConnections:    5,
+		ConnectionTimeout: 10 * time.Second,
+	}
+
+	pool, err := NewPool(ctx, getTestDBURL(), config, 2)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	// Wait for the pool to be filled
+	require.Eventually(t, func() bool { return pool.Stats().Ready == 2 }, 30*time.Second, 50*time.Millisecond)
+
+	first, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	second, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.DBName, second.DBName)
+
+	stats := pool.Stats()
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(0), stats.Misses)
+
+	var currentDB string
+	err = first.DB().QueryRowContext(ctx, "SELECT current_database()").Scan(&currentDB)
+	require.NoError(t, err)
+	assert.Equal(t, first.DBName, currentDB)
+
+	firstName := first.DBName
+	require.NoError(t, first.Close())
+	require.NoError(t, pool.Recycle(second))
+
+	adminDB, err := sql.Open("postgres", ReplaceDBName(getTestDBURL(), "postgres"))
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	require.Eventually(t, func() bool { return !databaseExists(t, adminDB, firstName) }, 10*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, pool.Close())
+	assert.Equal(t, 0, pool.Stats().Ready)
+
+	_, err = pool.Acquire(ctx)
+	require.Error(t, err)
+}
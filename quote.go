@@ -0,0 +1,92 @@
+package sql_sandbox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxGeneratedSuffixLength is the longest "_<nanos>_<pid>_<seq>" suffix a generated
+// name can realistically get: 19 digits of nanoseconds, a 7 digit PID and a 6 digit sequence
+const maxGeneratedSuffixLength = 1 + 19 + 1 + 7 + 1 + 6
+
+// quoteIdentifier quotes a name for use as an SQL identifier, doubling embedded quotes
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a string for use as an SQL string literal, doubling embedded quotes.
+// Strings containing backslashes are written as escape string constants, so that the
+// result does not depend on standard_conforming_strings.
+func quoteLiteral(s string) string {
+	s = strings.ReplaceAll(s, `'`, `''`)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.ReplaceAll(s, `\`, `\\`) + `'`
+	}
+	return `'` + s + `'`
+}
+
+// validateIdentifier checks that name can be used as a PostgreSQL identifier as is,
+// without being silently truncated by the server
+func validateIdentifier(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: %s must not be empty", ErrInvalidIdentifier, kind)
+	}
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%w: %s %q must not contain NUL characters", ErrInvalidIdentifier, kind, name)
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("%w: %s %q is %d bytes long, PostgreSQL identifiers are limited to %d bytes",
+			ErrInvalidIdentifier, kind, name, len(name), maxIdentifierLength)
+	}
+	return nil
+}
+
+// validateConfig checks the names in the configuration before any of them is sent to the server
+func validateConfig(config *Config) error {
+	// Generated names are the prefix followed by a unique suffix
+	if strings.ContainsRune(config.TestDBPrefix, 0) {
+		return fmt.Errorf("%w: test database prefix %q must not contain NUL characters", ErrInvalidIdentifier, config.TestDBPrefix)
+	}
+	if prefixLimit := maxIdentifierLength - maxGeneratedSuffixLength; len(config.TestDBPrefix) > prefixLimit {
+		return fmt.Errorf("%w: test database prefix %q is %d bytes long, at most %d bytes are left for it",
+			ErrInvalidIdentifier, config.TestDBPrefix, len(config.TestDBPrefix), prefixLimit)
+	}
+
+	if err := validateRole(config); err != nil {
+		return err
+	}
+	if err := validateSettings(config); err != nil {
+		return err
+	}
+	if err := config.CreateOptions.validate(); err != nil {
+		return err
+	}
+
+	if config.Isolation == IsolationSchema {
+		if config.TemplateFixtures != nil {
+			return fmt.Errorf("template fixtures are not supported with IsolationSchema")
+		}
+		if config.TemplateSchema != "" {
+			return validateIdentifier("template schema name", config.TemplateSchema)
+		}
+		return nil
+	}
+
+	if err := config.CreateOptions.checkTemplateBase(config); err != nil {
+		return err
+	}
+	if err := validateIdentifier("template database name", config.TemplateDBName); err != nil {
+		return err
+	}
+	if sourceDBName := ExtractDBName(config.MainDBURL); sourceDBName != "" {
+		if err := validateIdentifier("main database name", sourceDBName); err != nil {
+			return err
+		}
+	}
+	if config.MigrateTemplate && config.TemplateBase != "" {
+		if err := validateIdentifier("template base database name", config.TemplateBase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package sql_sandbox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ResetStrategy selects how Reset returns a sandbox to template state
+type ResetStrategy int
+
+const (
+	// ResetTruncate empties all user tables with TRUNCATE ... RESTART IDENTITY CASCADE,
+	// except Config.ReferenceTables, the tables of extensions and the tables of migration
+	// tools in the public schema, or the sandbox schema with IsolationSchema. Migration
+	// tables in other schemas are kept by listing them in Config.ReferenceTables.
+	// It keeps the connections and is fast for small data sets, but data the template
+	// holds in other tables is not restored.
+	ResetTruncate ResetStrategy = iota
+	// ResetRecreate drops the sandbox database and clones it from the template again
+	// under the same name. The pools of the sandbox are drained and reconnect on their
+	// next use. It requires IsolationDatabase.
+	ResetRecreate
+)
+
+// keptTables are the tables of migration tools, which ResetTruncate keeps in the schema
+// the tools default to
+var keptTables = map[string]bool{
+	"schema_migrations": true,
+	"goose_db_version":  true,
+}
+
+// Reset returns the sandbox to template state without changing its name or its
+// connection pool, e.g. between the iterations of a benchmark. It is not available
+// with IsolationTransaction.
+func (s *Sandbox) Reset(ctx context.Context, strategy ResetStrategy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.tx != nil:
+		return fmt.Errorf("reset is not supported with IsolationTransaction")
+	case s.closed || s.DBName == "":
+		return fmt.Errorf("sandbox is closed")
+	}
+
+	switch strategy {
+	case ResetTruncate:
+		return s.truncate(ctx)
+	case ResetRecreate:
+		if !s.ownsDatabase() {
+			return fmt.Errorf("ResetRecreate requires IsolationDatabase")
+		}
+		if err := s.recreate(ctx, s.Config.TemplateDBName); err != nil {
+			return fmt.Errorf("failed to reset test database: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown reset strategy %d", strategy)
+	}
+}
+
+// truncate empties the user tables of the sandbox in a single statement
+func (s *Sandbox) truncate(ctx context.Context) error {
+	// Tables of extensions, e.g. spatial_ref_sys of PostGIS, belong to the extension
+	query := `
+		SELECT n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p')
+			AND NOT c.relispartition
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND n.nspname NOT LIKE 'pg\_toast%'
+			AND n.nspname NOT LIKE 'pg\_temp\_%'
+			AND NOT EXISTS (
+				SELECT FROM pg_depend d
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+			)
+			AND ($1::text = '' OR n.nspname = $1::text)
+		ORDER BY n.nspname, c.relname
+	`
+	// Migration tools create their tables in the first schema of the search_path
+	migrationSchema := "public"
+	if s.Schema != "" {
+		migrationSchema = s.Schema
+	}
+
+	rows, err := s.TestDB.QueryContext(ctx, query, s.Schema)
+	if err != nil {
+		return fmt.Errorf("failed to list tables to truncate: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			return fmt.Errorf("failed to list tables to truncate: %w", err)
+		}
+		if keepTable(s.Config.ReferenceTables, migrationSchema, schema, table) {
+			continue
+		}
+		tables = append(tables, quoteIdentifier(schema)+"."+quoteIdentifier(table))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list tables to truncate: %w", err)
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	if _, err := s.TestDB.ExecContext(ctx, truncateStatement(tables)); err != nil {
+		return fmt.Errorf("failed to truncate tables: %w", err)
+	}
+	return nil
+}
+
+// keepTable reports whether ResetTruncate keeps the table. References are "table",
+// matching in every schema, or "schema.table". Migration tables are only kept in
+// migrationSchema, so that tables of the same name in other schemas are emptied.
+func keepTable(referenceTables []string, migrationSchema, schema, table string) bool {
+	if schema == migrationSchema && keptTables[table] {
+		return true
+	}
+	for _, ref := range referenceTables {
+		refSchema, refTable, qualified := strings.Cut(ref, ".")
+		if !qualified {
+			refSchema, refTable = "", ref
+		}
+		if refTable == table && (refSchema == "" || refSchema == schema) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateStatement returns the statement emptying the quoted tables
+func truncateStatement(tables []string) string {
+	return `TRUNCATE TABLE ` + strings.Join(tables, ", ") + ` RESTART IDENTITY CASCADE`
+}
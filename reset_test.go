@@ -0,0 +1,118 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepTable(t *testing.T) {
+	refs := []string{"countries", "billing.plans"}
+
+	assert.True(t, keepTable(refs, "public", "public", "countries"))
+	assert.True(t, keepTable(refs, "public", "geo", "countries"))
+	assert.True(t, keepTable(refs, "public", "billing", "plans"))
+	assert.False(t, keepTable(refs, "public", "public", "plans"))
+	assert.False(t, keepTable(refs, "public", "public", "users"))
+	assert.True(t, keepTable(nil, "public", "public", "schema_migrations"))
+	assert.True(t, keepTable(nil, "public", "public", "goose_db_version"))
+
+	// Tables named like migration tables are only kept in the migration schema
+	assert.False(t, keepTable(nil, "public", "app", "schema_migrations"))
+	assert.True(t, keepTable(nil, "test_schema", "test_schema", "schema_migrations"))
+	assert.True(t, keepTable([]string{"migrations.schema_migrations"}, "public", "migrations", "schema_migrations"))
+}
+
+func TestTruncateStatement(t *testing.T) {
+	assert.Equal(t, `TRUNCATE TABLE "public"."users", "billing"."Invoices" RESTART IDENTITY CASCADE`,
+		truncateStatement([]string{`"public"."users"`, `"billing"."Invoices"`}))
+}
+
+func TestResetErrors(t *testing.T) {
+	ctx := context.Background()
+
+	err := (&Sandbox{DBName: "shared", tx: &txConnector{}}).Reset(ctx, ResetTruncate)
+	assert.ErrorContains(t, err, "IsolationTransaction")
+
+	err = (&Sandbox{}).Reset(ctx, ResetTruncate)
+	assert.ErrorContains(t, err, "closed")
+
+	err = (&Sandbox{DBName: "main", Schema: "test_schema"}).Reset(ctx, ResetRecreate)
+	assert.ErrorContains(t, err, "ResetRecreate requires IsolationDatabase")
+
+	// Closed sandboxes keep their names, the main database of a schema sandbox included
+	err = (&Sandbox{DBName: "main", Schema: "test_schema", closed: true}).Reset(ctx, ResetRecreate)
+	assert.ErrorContains(t, err, "closed")
+
+	err = (&Sandbox{DBName: "test_db", closed: true}).Reset(ctx, ResetRecreate)
+	assert.ErrorContains(t, err, "closed")
+
+	err = (&Sandbox{DBName: "test_db"}).Reset(ctx, ResetStrategy(42))
+	assert.ErrorContains(t, err, "unknown reset strategy 42")
+}
+
+func TestReset(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+
+	for _, strategy := range []ResetStrategy{ResetTruncate, ResetRecreate} {
+		config := DefaultConfig()
+		config.TestDBPrefix = "test_reset_"
+		config.ReferenceTables = []string{"reset_countries"}
+
+		sandbox := NewT(t, getTestDBURL(), config)
+		db := sandbox.DB()
+		for _, stmt := range []string{
+			"CREATE TABLE reset_countries (code text PRIMARY KEY)",
+			"CREATE TABLE reset_users (id serial PRIMARY KEY, country text REFERENCES reset_countries)",
+			"INSERT INTO reset_countries VALUES ('de')",
+			"INSERT INTO reset_users (country) VALUES ('de'), ('de')",
+		} {
+			_, err := db.ExecContext(ctx, stmt)
+			require.NoError(t, err, stmt)
+		}
+		dbName := sandbox.DBName
+
+		require.NoError(t, sandbox.Reset(ctx, strategy))
+		assert.Equal(t, dbName, sandbox.DBName)
+		assert.Same(t, db, sandbox.DB())
+
+		var exists bool
+		require.NoError(t, db.QueryRowContext(ctx, "SELECT to_regclass('reset_users') IS NOT NULL").Scan(&exists))
+		if strategy == ResetRecreate {
+			// The tables created by the test are gone with the database
+			assert.False(t, exists)
+			continue
+		}
+
+		require.True(t, exists)
+		var users, countries, nextID int
+		require.NoError(t, db.QueryRowContext(ctx, "SELECT count(*) FROM reset_users").Scan(&users))
+		require.NoError(t, db.QueryRowContext(ctx, "SELECT count(*) FROM reset_countries").Scan(&countries))
+		require.NoError(t, db.QueryRowContext(ctx, "INSERT INTO reset_users (country) VALUES ('de') RETURNING id").Scan(&nextID))
+		assert.Equal(t, 0, users)
+		assert.Equal(t, 1, countries)
+		assert.Equal(t, 1, nextID)
+	}
+
+	// A closed sandbox is not recreated as an orphan database
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_reset_"
+	sandbox, err := New(getTestDBURL(), config)
+	require.NoError(t, err)
+	require.NoError(t, sandbox.Close())
+	assert.ErrorContains(t, sandbox.Reset(ctx, ResetRecreate), "closed")
+
+	mainDB, err := sql.Open("postgres", getTestDBURL())
+	require.NoError(t, err)
+	defer mainDB.Close()
+	var exists bool
+	require.NoError(t, mainDB.QueryRowContext(ctx, "SELECT EXISTS(SELECT FROM pg_database WHERE datname = $1)", sandbox.DBName).Scan(&exists))
+	assert.False(t, exists)
+}
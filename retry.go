@@ -0,0 +1,117 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// cloneDatabase creates the test database from the template, retrying with exponential
+// backoff and jitter while other sessions are connected to the template. Every attempt
+// waits for a free slot of the limiter, which is not held during the backoff.
+func cloneDatabase(ctx context.Context, adminDB *sql.DB, limiter *ddlLimiter, config *Config, testDBName string) error {
+	return cloneDatabaseFrom(ctx, adminDB, limiter, config, config.TemplateDBName, testDBName)
+}
+
+// cloneDatabaseFrom creates a database from the given template, e.g. a checkpoint, like
+// cloneDatabase does from the configured template
+func cloneDatabaseFrom(ctx context.Context, adminDB *sql.DB, limiter *ddlLimiter, config *Config, templateDBName, testDBName string) error {
+	backoff := config.CloneRetryBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := limiter.do(ctx, adminDB, func(db execer) error {
+			if _, err := createTestDatabase(ctx, db, templateDBName, testDBName, config.CreateOptions); err != nil {
+				return err
+			}
+			// Settings are not cloned from the template
+			if err := applyDatabaseSettings(ctx, db, testDBName, config.Settings); err != nil {
+				if dropErr := dropTestDatabase(context.Background(), db, testDBName); dropErr != nil {
+					log.Printf("Warning: failed to drop test database: %v", dropErr)
+				}
+				return err
+			}
+			return nil
+		})
+		if err == nil || !errors.Is(err, ErrTemplateBusy) {
+			return err
+		}
+
+		if attempt >= config.CloneRetries {
+			// Report who is holding the template
+			var dbErr *DatabaseError
+			if errors.As(err, &dbErr) {
+				sessions, sessionsErr := connectedSessions(ctx, adminDB, templateDBName)
+				if sessionsErr != nil {
+					log.Printf("Warning: failed to list sessions connected to template database: %v", sessionsErr)
+				}
+				dbErr.Sessions = sessions
+			}
+			return err
+		}
+
+		if config.TerminateTemplateConnections {
+			if err := terminateConnections(ctx, adminDB, templateDBName); err != nil {
+				log.Printf("Warning: failed to terminate connections to template database: %v", err)
+			}
+		}
+
+		delay := retryDelay(backoff, attempt)
+		log.Printf("Template database '%s' is busy, retrying in %s (attempt %d of %d)", templateDBName, delay, attempt+1, config.CloneRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to create test database: %w", ctx.Err())
+		}
+	}
+}
+
+// retryDelay returns the exponential backoff for the attempt with up to ±50% jitter
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	delay := backoff << min(attempt, 16)
+	return delay/2 + rand.N(delay)
+}
+
+// connectedSessions describes the sessions connected to the database
+func connectedSessions(ctx context.Context, adminDB *sql.DB, dbName string) ([]string, error) {
+	rows, err := adminDB.QueryContext(ctx, `
+		SELECT pid, COALESCE(usename, ''), application_name, COALESCE(host(client_addr), 'local'), COALESCE(state, '')
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()
+		ORDER BY pid
+	`, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var pid int
+		var user, application, client, state string
+		if err := rows.Scan(&pid, &user, &application, &client, &state); err != nil {
+			return nil, err
+		}
+		if application == "" {
+			application = "unknown application"
+		}
+		sessions = append(sessions, fmt.Sprintf("pid %d: %s via %s from %s (%s)", pid, user, application, client, state))
+	}
+	return sessions, rows.Err()
+}
+
+// terminateConnections terminates all other sessions connected to the database
+func terminateConnections(ctx context.Context, adminDB execer, dbName string) error {
+	_, err := adminDB.ExecContext(ctx, `
+		SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()
+	`, dbName)
+	return err
+}
@@ -0,0 +1,61 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		expected := backoff << attempt
+		for i := 0; i < 20; i++ {
+			delay := retryDelay(backoff, attempt)
+			assert.GreaterOrEqual(t, delay, expected/2)
+			assert.Less(t, delay, expected/2+expected)
+		}
+	}
+
+	// Large attempt numbers do not overflow
+	assert.Positive(t, retryDelay(backoff, 100))
+}
+
+func TestCloneDatabaseTemplateBusy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	sandbox, err := New(getTestDBURL(), nil)
+	require.NoError(t, err)
+	require.NoError(t, sandbox.Close())
+
+	config := *sandbox.Config
+	config.CloneRetries = 1
+	config.CloneRetryBackoff = 10 * time.Millisecond
+
+	adminDB, err := openAdminDB(ctx, &config)
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	// A stray session keeps the template busy
+	stray, err := sql.Open("postgres", withConnParam(ReplaceDBName(config.MainDBURL, config.TemplateDBName), "application_name", "stray_session"))
+	require.NoError(t, err)
+	defer stray.Close()
+	require.NoError(t, stray.PingContext(ctx))
+
+	testDBName := generateUniqueDBName(config.TestDBPrefix)
+	err = cloneDatabase(ctx, adminDB, nil, &config, testDBName)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrTemplateBusy)
+	assert.Contains(t, err.Error(), "stray_session")
+
+	config.TerminateTemplateConnections = true
+	require.NoError(t, cloneDatabase(ctx, adminDB, nil, &config, testDBName))
+	require.NoError(t, dropTestDatabase(ctx, adminDB, testDBName))
+}
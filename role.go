@@ -0,0 +1,113 @@
+package sql_sandbox
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// RoleConfig configures the login role created for every sandbox with Config.Role.
+// The role is named like the sandbox database and dropped together with it.
+type RoleConfig struct {
+	// MemberOf lists the roles the sandbox role is made a member of, typically the
+	// group roles the application gets its privileges through
+	MemberOf []string
+	// Owner makes the sandbox role the owner of the sandbox database. Objects cloned
+	// from the template keep their owners.
+	Owner bool
+}
+
+// validateRole checks the role configuration before any of it is sent to the server
+func validateRole(config *Config) error {
+	if config.Role == nil {
+		return nil
+	}
+	if config.Isolation != IsolationDatabase {
+		return fmt.Errorf("sandbox roles require IsolationDatabase")
+	}
+	for _, role := range config.Role.MemberOf {
+		if err := validateIdentifier("sandbox role membership", role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRole creates the login role of the sandbox and connects to the sandbox database as it
+func (m *Manager) addRole(ctx context.Context, s *Sandbox) error {
+	// Set before creating the role so that Close drops it after a partial failure
+	s.Role = s.DBName
+	password := rand.Text()
+	if err := createSandboxRole(ctx, m.adminDB, m.config.Role, s.Role, password); err != nil {
+		return err
+	}
+
+	roleURL, err := withCredentials(ReplaceDBName(m.config.MainDBURL, s.DBName), s.Role, password)
+	if err != nil {
+		return err
+	}
+	roleDB, err := openTestDBConnStr(ctx, m.config, roleURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect as sandbox role: %w", err)
+	}
+	s.roleDB = roleDB
+	return nil
+}
+
+// createSandboxRole creates a login role named like the sandbox database and grants it
+// access to the database
+func createSandboxRole(ctx context.Context, adminDB *sql.DB, config *RoleConfig, dbName, password string) error {
+	stmt := `CREATE ROLE ` + quoteIdentifier(dbName) + ` LOGIN PASSWORD ` + quoteLiteral(password)
+	if len(config.MemberOf) > 0 {
+		roles := make([]string, len(config.MemberOf))
+		for i, role := range config.MemberOf {
+			roles[i] = quoteIdentifier(role)
+		}
+		stmt += ` IN ROLE ` + strings.Join(roles, ", ")
+	}
+	if _, err := adminDB.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("failed to create sandbox role: %w", err)
+	}
+	return grantSandboxRole(ctx, adminDB, config, dbName)
+}
+
+// grantSandboxRole grants the sandbox role access to the database it is named after,
+// again after the database was recreated
+func grantSandboxRole(ctx context.Context, adminDB *sql.DB, config *RoleConfig, dbName string) error {
+	grant := `GRANT CONNECT ON DATABASE ` + quoteIdentifier(dbName) + ` TO ` + quoteIdentifier(dbName)
+	if config.Owner {
+		grant = `ALTER DATABASE ` + quoteIdentifier(dbName) + ` OWNER TO ` + quoteIdentifier(dbName)
+	}
+	if _, err := adminDB.ExecContext(ctx, grant); err != nil {
+		return fmt.Errorf("failed to grant sandbox role access to database: %w", err)
+	}
+	return nil
+}
+
+// dropSandboxRole drops the login role of a sandbox after its database was dropped
+func dropSandboxRole(ctx context.Context, adminDB *sql.DB, role string) error {
+	if _, err := adminDB.ExecContext(ctx, `DROP ROLE IF EXISTS `+quoteIdentifier(role)); err != nil {
+		return fmt.Errorf("failed to drop sandbox role: %w", err)
+	}
+	return nil
+}
+
+// withCredentials sets the user and password of a connection string
+func withCredentials(connStr, user, password string) (string, error) {
+	c, err := ParseConnString(connStr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	c.Set("user", user)
+	c.Set("password", password)
+	return c.String(), nil
+}
+
+// RoleDB returns the connection pool to the sandbox database connected as the sandbox
+// role, or nil if Config.Role is not set. Use it for the code under test and DB for
+// fixtures that need more privileges.
+func (s *Sandbox) RoleDB() *sql.DB {
+	return s.roleDB
+}
@@ -3,15 +3,19 @@ package sql_sandbox
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/lib/pq"
 )
 
@@ -19,8 +23,31 @@ import (
 type Sandbox struct {
 	TestDB *sql.DB
 	DBName string
-	Config *Config
-	mu     sync.Mutex
+	// Schema is the test schema when the sandbox uses IsolationSchema
+	Schema string
+	// Role is the login role created for the sandbox with Config.Role
+	Role    string
+	Config  *Config
+	mu      sync.Mutex
+	pool    *Pool
+	tx      *txConnector
+	manager *Manager
+	roleDB  *sql.DB
+
+	sessionDBs []*sql.DB
+
+	// parent is the sandbox this one was forked from, children the forks still open
+	parent   *Sandbox
+	children []*Sandbox
+
+	pgxPool  *pgxpool.Pool
+	pgxConns []*pgx.Conn
+
+	// closed is set by Close and retain, after which the sandbox owns nothing to drop
+	closed bool
+
+	// testCleanup is the Cleanup method of the test the sandbox was created for by NewT
+	testCleanup func(func())
 }
 
 type setupState struct {
@@ -28,7 +55,11 @@ type setupState struct {
 	err  error
 }
 
-var setupMap sync.Map // map[string]*setupState
+// setupMap and sharedDBMap remember the setup done for sandboxes created without a Manager
+var (
+	setupMap    sync.Map // map[string]*setupState
+	sharedDBMap sync.Map // map[string]*setupState
+)
 
 // Config holds the configuration for the sandbox
 type Config struct {
@@ -37,8 +68,95 @@ type Config struct {
 	TestDBPrefix      string
 	MaxConnections    int
 	ConnectionTimeout time.Duration
+	// RetainOnFailure keeps the test database of a failed test created with NewT
+	// instead of dropping it. It can also be enabled with the
+	// SQL_SANDBOX_RETAIN_ON_FAILURE environment variable.
+	RetainOnFailure bool
+	// Isolation selects how sandboxes are isolated from each other, defaults to IsolationDatabase
+	Isolation IsolationMode
+	// MigrateTemplate builds the template by creating an empty database from TemplateBase
+	// and running the migration checker against it. The main database is then neither
+	// migrated nor disconnected, and only its connection settings are used.
+	MigrateTemplate bool
+	// TemplateBase is the database an empty template is created from with MigrateTemplate,
+	// defaults to template0
+	TemplateBase string
+	// CloneRetries is the number of times cloning a database is retried while other
+	// sessions are connected to the template
+	CloneRetries int
+	// CloneRetryBackoff is the delay before the first retry, doubled for every further
+	// retry and randomized by up to 50%. Defaults to 100ms.
+	CloneRetryBackoff time.Duration
+	// TerminateTemplateConnections terminates other sessions connected to the template
+	// before retrying to clone it
+	TerminateTemplateConnections bool
+	// TemplateSchema is the schema cloned into every sandbox with IsolationSchema, defaults to public
+	TemplateSchema string
+	// AdminMaxConnections limits the admin connection pool used to create and drop
+	// sandboxes, at least 2 connections are used
+	AdminMaxConnections int
+	// MaxConcurrentDDL limits the number of CREATE and DROP DATABASE statements for
+	// sandboxes running at the same time in this process against the same server.
+	// The limit of the first sandbox for a server applies. 0 means unlimited.
+	MaxConcurrentDDL int
+	// ClusterMaxConcurrentDDL limits the number of such statements across all processes
+	// using the server, with advisory locks. 0 means unlimited.
+	ClusterMaxConcurrentDDL int
+	// Driver selects the database/sql driver for admin and sandbox connections,
+	// defaults to DriverPQ
+	Driver Driver
+	// CreateOptions are options of the CREATE DATABASE statements for the template and
+	// sandbox databases. Options the server does not support are reported by New.
+	CreateOptions *CreateOptions
+	// Settings are session defaults applied to every sandbox database with
+	// ALTER DATABASE ... SET right after cloning, so that all its connections inherit
+	// them. With IsolationSchema they are passed as connection parameters instead. They
+	// are not supported with CreateOptions.Owner.
+	Settings map[string]string
+	// Role creates a login role for every sandbox, available through RoleDB. It
+	// requires IsolationDatabase and an admin role that may create roles.
+	Role *RoleConfig
+	// AdminURL is the connection string used to create and drop databases, e.g. with a
+	// role that has CREATEDB. Sandbox connections keep using MainDBURL. Defaults to
+	// MainDBURL with the database replaced by MaintenanceDB.
+	AdminURL string
+	// MaintenanceDB is the database connected to for database-level operations when
+	// AdminURL is not set. Defaults to postgres, falling back to template1 when postgres
+	// does not exist or cannot be connected to.
+	MaintenanceDB string
+	// ReferenceTables are the tables Reset with ResetTruncate keeps, e.g. lookup data
+	// inserted by migrations, as "table" in any schema or "schema.table". Tables that
+	// reference truncated tables are emptied by the CASCADE nonetheless.
+	ReferenceTables []string
+	// TemplateFixtures are loaded once into the template database when it is built, so
+	// that every sandbox starts with them. The template is rebuilt when they change.
+	// They are not supported with IsolationSchema.
+	TemplateFixtures *Fixtures
 }
 
+// IsolationMode selects how a sandbox isolates a test from other tests
+type IsolationMode int
+
+const (
+	// IsolationDatabase clones a new database from the template for every sandbox
+	IsolationDatabase IsolationMode = iota
+	// IsolationTransaction runs every sandbox on a single connection to a shared clone
+	// of the template, inside a transaction that is rolled back on Close.
+	// Transactions started by the test become savepoints. A failed statement aborts
+	// the whole sandbox transaction unless it runs inside such a nested transaction.
+	IsolationTransaction
+	// IsolationSchema clones the template schema of the main database into a new schema
+	// for every sandbox and points the search_path of the sandbox connections at it.
+	// It neither needs the CREATEDB privilege nor creates a template database.
+	IsolationSchema
+)
+
+// RetainOnFailureEnv is the environment variable that enables Config.RetainOnFailure
+const RetainOnFailureEnv = "SQL_SANDBOX_RETAIN_ON_FAILURE"
+
+// retainedCommentPrefix starts the comment set on databases retained after a test failure
+const retainedCommentPrefix = "sql_sandbox: retained"
+
 // DefaultConfig returns a default configuration
 func DefaultConfig() *Config {
 	return &Config{
@@ -46,6 +164,17 @@ func DefaultConfig() *Config {
 		TestDBPrefix:      "test_db_",
 		MaxConnections:    10,
 		ConnectionTimeout: 30 * time.Second,
+		TemplateSchema:    "public",
+		TemplateBase:      "template0",
+		CloneRetries:      5,
+		CloneRetryBackoff: 100 * time.Millisecond,
+
+		AdminMaxConnections: 4,
+		Settings: map[string]string{
+			"statement_timeout": "60s",
+			"lock_timeout":      "10s",
+			"TimeZone":          "UTC",
+		},
 	}
 }
 
@@ -66,69 +195,214 @@ func NewWithMigrationChecker(mainDBURL string, config *Config, migrationChecker
 
 // NewWithMigrationCheckerAndContext creates a new sandbox instance with a custom migration checker and context
 func NewWithMigrationCheckerAndContext(ctx context.Context, mainDBURL string, config *Config, migrationChecker MigrationChecker) (*Sandbox, error) {
+	return newSandbox(ctx, mainDBURL, config, migrationChecker, "")
+}
+
+// newSandbox creates a new sandbox instance over a short-lived manager that shares
+// the setup state of the package. When testName is not empty the test database name
+// is derived from it, otherwise a generic unique name is used.
+func newSandbox(ctx context.Context, mainDBURL string, config *Config, migrationChecker MigrationChecker, testName string) (*Sandbox, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
 	config.MainDBURL = mainDBURL
 
-	// Use default migration checker if none provided
-	if migrationChecker == nil {
-		migrationChecker = &DefaultMigrationChecker{}
+	m, err := openManager(ctx, config, migrationChecker, &setupMap, &sharedDBMap)
+	if err != nil {
+		return nil, err
 	}
+	defer m.Close()
 
-	// Determine source database name from connection string
-	sourceDBName := ExtractDBName(config.MainDBURL)
-	if sourceDBName == "" {
-		sourceDBName = "main_db"
+	return m.newSandbox(ctx, testName)
+}
+
+// adminConnStrings returns the connection strings for database-level operations, in the
+// order they are tried
+func adminConnStrings(config *Config) []string {
+	switch {
+	case config.AdminURL != "":
+		return []string{config.AdminURL}
+	case config.MaintenanceDB != "":
+		return []string{ReplaceDBName(config.MainDBURL, config.MaintenanceDB)}
+	default:
+		return []string{ReplaceDBName(config.MainDBURL, "postgres"), ReplaceDBName(config.MainDBURL, "template1")}
 	}
+}
+
+// openAdminDB connects to the maintenance database to manage DB-level operations. Without
+// an explicitly configured one it falls back to template1 when postgres is not available.
+func openAdminDB(ctx context.Context, config *Config) (*sql.DB, error) {
+	var errs []error
+	for _, adminConnStr := range adminConnStrings(config) {
+		adminDB, err := openDB(config, adminConnStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to admin database: %w", err)
+		}
+
+		// Test admin database connection with context
+		err = adminDB.PingContext(ctx)
+		if err == nil {
+			return adminDB, nil
+		}
+		adminDB.Close()
 
-	// Connect to maintenance database (postgres) to manage DB-level operations
-	adminConnStr := ReplaceDBName(config.MainDBURL, "postgres")
-	adminDB, err := sql.Open("postgres", adminConnStr)
+		errs = append(errs, err)
+		if code := errorCode(err); code != codeInvalidCatalogName && code != codeInsufficientPrivilege {
+			break
+		}
+	}
+	return nil, fmt.Errorf("failed to ping admin database: %w", errors.Join(errs...))
+}
+
+// openMainDB connects to the main database to manage schemas in it
+func openMainDB(ctx context.Context, config *Config) (*sql.DB, error) {
+	mainDB, err := openDB(config, config.MainDBURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to admin database: %w", err)
+		return nil, fmt.Errorf("failed to connect to main database: %w", err)
+	}
+
+	// Test main database connection with context
+	if err := mainDB.PingContext(ctx); err != nil {
+		mainDB.Close()
+		return nil, fmt.Errorf("failed to ping main database: %w", err)
 	}
-	defer adminDB.Close()
 
-	// Test admin database connection with context
-	if err := adminDB.PingContext(ctx); err != nil {
-		return nil, fmt.Errorf("failed to ping admin database: %w", err)
+	return mainDB, nil
+}
+
+// ensureTemplate migrates the main database and creates the template database from it,
+// once per source database and template name
+func (m *Manager) ensureTemplate(ctx context.Context) error {
+	config := m.config
+
+	// Determine source database name from connection string
+	sourceDBName := connDBName(config.MainDBURL)
+	if config.MigrateTemplate {
+		sourceDBName = templateBase(config)
 	}
 
 	// Ensure template DB setup is done only once per sourceDBName + TemplateDBName
 	setupKey := sourceDBName + "|" + config.TemplateDBName
-	stateAny, _ := setupMap.LoadOrStore(setupKey, &setupState{})
+	stateAny, _ := m.setupMap.LoadOrStore(setupKey, &setupState{})
 	state := stateAny.(*setupState)
 
 	state.once.Do(func() {
+		state.err = buildTemplate(ctx, m.adminDB, config, m.migrationChecker, sourceDBName)
+	})
+
+	return state.err
+}
+
+// buildTemplate creates the template database unless an up to date one exists. It runs
+// under an advisory lock, so that exactly one process builds the template while the
+// others wait for it to be complete.
+func buildTemplate(ctx context.Context, adminDB *sql.DB, config *Config, migrationChecker MigrationChecker, sourceDBName string) error {
+	fingerprint, err := migrationFingerprint(migrationChecker)
+	if err != nil {
+		return err
+	}
+	// Templates created with other options are rebuilt as well
+	if clause := config.CreateOptions.clause(); clause != "" {
+		fingerprint = strings.TrimSpace(fingerprint + " with" + clause)
+	}
+	if config.TemplateFixtures != nil {
+		fingerprint = strings.TrimSpace(fingerprint + " fixtures=" + config.TemplateFixtures.digest)
+	}
+
+	release, err := acquireAdvisoryLock(ctx, adminDB, "template|"+sourceDBName+"|"+config.TemplateDBName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !config.MigrateTemplate {
 		// Ensure main database is migrated to latest version
 		if err := migrationChecker.EnsureMigratedWithContext(ctx, config.MainDBURL); err != nil {
-			state.err = fmt.Errorf("failed to ensure main DB is migrated: %w", err)
-			return
+			return fmt.Errorf("failed to ensure main DB is migrated: %w", err)
 		}
+	}
+
+	// The comment is written once the template is complete, so a template without it
+	// was left behind by an interrupted build or built from different migrations
+	complete, err := templateComplete(ctx, adminDB, config.TemplateDBName, fingerprint)
+	if err != nil {
+		return err
+	}
+	if complete {
+		log.Printf("Template database '%s' is up to date", config.TemplateDBName)
+		return nil
+	}
 
+	if config.MigrateTemplate {
+		if err := createMigratedTemplate(ctx, adminDB, config, migrationChecker); err != nil {
+			return err
+		}
+	} else {
 		// Create template database if it doesn't exist
-		if err := createTemplateDatabase(ctx, adminDB, sourceDBName, config.TemplateDBName); err != nil {
-			state.err = fmt.Errorf("failed to create template database: %w", err)
-			return
+		if err := createTemplateDatabase(ctx, adminDB, sourceDBName, config.TemplateDBName, config.CreateOptions); err != nil {
+			return fmt.Errorf("failed to create template database: %w", err)
 		}
-	})
+	}
 
-	if state.err != nil {
-		return nil, state.err
+	if config.TemplateFixtures != nil {
+		if err := loadTemplateFixtures(ctx, adminDB, config); err != nil {
+			return err
+		}
 	}
 
-	// Generate unique test database name
-	testDBName := generateUniqueDBName(config.TestDBPrefix)
+	if err := commentOnDatabase(ctx, adminDB, config.TemplateDBName, fingerprintCommentPrefix+fingerprint); err != nil {
+		return fmt.Errorf("failed to store template fingerprint: %w", err)
+	}
 
-	// Create test database from the template database
-	_, err = createTestDatabase(ctx, adminDB, config.TemplateDBName, testDBName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create test database: %w", err)
+	return nil
+}
+
+// createMigratedTemplate creates the template database empty from the template base and
+// migrates it, leaving the main database untouched
+func createMigratedTemplate(ctx context.Context, adminDB *sql.DB, config *Config, migrationChecker MigrationChecker) error {
+	base := templateBase(config)
+	log.Printf("Attempting to create template database '%s' from empty database '%s'", config.TemplateDBName, base)
+
+	// Create template database if it doesn't exist
+	if err := createDatabaseIfNotExists(ctx, adminDB, base, config.TemplateDBName, config.CreateOptions); err != nil {
+		return fmt.Errorf("failed to create template database: %w", err)
 	}
 
-	// Connect to test database
-	testDBConn, err := sql.Open("postgres", ReplaceDBName(config.MainDBURL, testDBName))
+	// Ensure template database is migrated to latest version
+	templateURL := ReplaceDBName(config.MainDBURL, config.TemplateDBName)
+	if err := migrationChecker.EnsureMigratedWithContext(ctx, templateURL); err != nil {
+		// Do not leave a partially migrated template behind for the next run
+		if dropErr := dropTestDatabase(context.Background(), adminDB, config.TemplateDBName); dropErr != nil {
+			log.Printf("Warning: failed to drop template database after failed migration: %v", dropErr)
+		}
+		return fmt.Errorf("failed to ensure template DB is migrated: %w", err)
+	}
+
+	// Connections left open by the migration checker would keep the template from being cloned
+	if err := terminateConnections(ctx, adminDB, config.TemplateDBName); err != nil {
+		log.Printf("Warning: failed to terminate connections to template database: %v", err)
+	}
+
+	return nil
+}
+
+// templateBase returns the database an empty template database is created from
+func templateBase(config *Config) string {
+	if config.TemplateBase == "" {
+		return "template0"
+	}
+	return config.TemplateBase
+}
+
+// openTestDB connects to the test database and configures its connection pool
+func openTestDB(ctx context.Context, config *Config, testDBName string) (*sql.DB, error) {
+	return openTestDBConnStr(ctx, config, ReplaceDBName(config.MainDBURL, testDBName))
+}
+
+// openTestDBConnStr connects to the test database using the given connection string
+// and configures its connection pool
+func openTestDBConnStr(ctx context.Context, config *Config, connStr string) (*sql.DB, error) {
+	testDBConn, err := openDB(config, connStr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to test database: %w", err)
 	}
@@ -143,11 +417,7 @@ func NewWithMigrationCheckerAndContext(ctx context.Context, mainDBURL string, co
 	testDBConn.SetMaxOpenConns(config.MaxConnections)
 	testDBConn.SetConnMaxLifetime(config.ConnectionTimeout)
 
-	return &Sandbox{
-		TestDB: testDBConn,
-		DBName: testDBName,
-		Config: config,
-	}, nil
+	return testDBConn, nil
 }
 
 // DB returns the test database connection
@@ -155,30 +425,82 @@ func (s *Sandbox) DB() *sql.DB {
 	return s.TestDB
 }
 
-// Close closes the sandbox and cleans up the test database
+// Close closes the sandbox and cleans up the test database.
+// Sandboxes acquired from a Pool are released back to it.
 func (s *Sandbox) Close() error {
+	if s.pool != nil {
+		return s.pool.Release(s)
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
 
+	// Children are cloned from the sandbox and closed before it
 	var errors []string
+	if err := s.closeChildren(); err != nil {
+		errors = append(errors, err.Error())
+	}
+	s.unlinkParent()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Close test database connection
+	// Close test database connections
 	if s.TestDB != nil {
 		if err := s.TestDB.Close(); err != nil {
 			errors = append(errors, fmt.Sprintf("failed to close test DB connection: %v", err))
 		}
 	}
+	if s.roleDB != nil {
+		if err := s.roleDB.Close(); err != nil {
+			errors = append(errors, fmt.Sprintf("failed to close sandbox role connection: %v", err))
+		}
+	}
+	if err := s.closePgx(); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if err := s.closeSessions(); err != nil {
+		errors = append(errors, err.Error())
+	}
 
-	// Drop test database
-	if s.DBName != "" {
-		adminConnStr := ReplaceDBName(s.Config.MainDBURL, "postgres")
-		adminDB, err := sql.Open("postgres", adminConnStr)
+	// Roll back the sandbox transaction, the shared database is kept
+	if s.tx != nil {
+		if err := s.tx.rollback(); err != nil {
+			errors = append(errors, err.Error())
+		}
+	} else if s.Schema != "" {
+		// Drop test schema, the main database is kept
+		mainDB, release, err := s.adminConn()
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("failed to connect to main DB to drop test schema: %v", err))
+		} else {
+			defer release()
+			if err := dropTestSchema(context.Background(), mainDB, s.Schema); err != nil {
+				errors = append(errors, err.Error())
+			}
+		}
+	} else if s.DBName != "" {
+		// Drop test database
+		adminDB, release, err := s.adminConn()
 		if err != nil {
 			errors = append(errors, fmt.Sprintf("failed to connect to admin DB to drop test DB: %v", err))
 		} else {
-			defer adminDB.Close()
-			if err := dropTestDatabase(context.Background(), adminDB, s.DBName); err != nil {
+			defer release()
+			limiter := newDDLLimiter(s.Config)
+			if s.manager != nil {
+				limiter = s.manager.limiter
+			}
+			if err := limiter.dropDatabase(context.Background(), adminDB, s.DBName); err != nil {
 				errors = append(errors, fmt.Sprintf("failed to drop test database: %v", err))
+			} else if s.Role != "" {
+				if err := dropSandboxRole(context.Background(), adminDB, s.Role); err != nil {
+					errors = append(errors, err.Error())
+				}
 			}
 		}
 	}
@@ -190,57 +512,159 @@ func (s *Sandbox) Close() error {
 	return nil
 }
 
+// ownsDatabase reports whether the sandbox database was created for the sandbox alone,
+// i.e. with IsolationDatabase, rather than being the main or the shared database
+func (s *Sandbox) ownsDatabase() bool {
+	if s.Config != nil && s.Config.Isolation != IsolationDatabase {
+		return false
+	}
+	return s.tx == nil && s.Schema == ""
+}
+
+// adminConn returns the connection pool to destroy the sandbox with: the admin pool of
+// its manager, or else a new connection that the returned function closes
+func (s *Sandbox) adminConn() (*sql.DB, func(), error) {
+	if s.manager != nil {
+		return s.manager.adminDB, func() {}, nil
+	}
+
+	open := openAdminDB
+	if s.Schema != "" {
+		open = openMainDB
+	}
+	db, err := open(context.Background(), s.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, func() { db.Close() }, nil
+}
+
+// detach closes the sandbox connection pool and hands over ownership of the test
+// database to the caller, returning its name. Subsequent calls return an empty name.
+func (s *Sandbox) detach() (string, error) {
+	err := s.closeChildren()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.TestDB != nil {
+		if closeErr := s.TestDB.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close test DB connection: %w", closeErr)
+		}
+		s.TestDB = nil
+	}
+	if closeErr := s.closePgx(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := s.closeSessions(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	name := s.DBName
+	s.DBName = ""
+	return name, err
+}
+
+// retain closes the sandbox connection pool without dropping the test database and
+// marks the database with a comment naming the test it was retained for.
+// It returns the connection string of the retained database with the password redacted.
+func (s *Sandbox) retain(ctx context.Context, testName string) (string, error) {
+	if err := s.closeChildren(); err != nil {
+		return "", err
+	}
+	// The parent must not drop the retained database when it is closed
+	s.unlinkParent()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+
+	if s.TestDB != nil {
+		if err := s.TestDB.Close(); err != nil {
+			return "", fmt.Errorf("failed to close test DB connection: %w", err)
+		}
+	}
+	if s.roleDB != nil {
+		if err := s.roleDB.Close(); err != nil {
+			return "", fmt.Errorf("failed to close sandbox role connection: %w", err)
+		}
+	}
+	if err := s.closePgx(); err != nil {
+		return "", err
+	}
+	if err := s.closeSessions(); err != nil {
+		return "", err
+	}
+
+	adminDB, release, err := s.adminConn()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to admin DB to retain test DB: %w", err)
+	}
+	defer release()
+
+	comment := fmt.Sprintf("%s after failure of %s at %s", retainedCommentPrefix, testName, time.Now().Format(time.RFC3339))
+	if err := commentOnDatabase(ctx, adminDB, s.DBName, comment); err != nil {
+		return "", fmt.Errorf("failed to comment retained test database: %w", err)
+	}
+
+	return RedactPassword(ReplaceDBName(s.Config.MainDBURL, s.DBName)), nil
+}
+
+// shouldRetainOnFailure reports whether failed test databases should be kept
+func shouldRetainOnFailure(config *Config) bool {
+	if config != nil && config.Isolation != IsolationDatabase {
+		// Only a database of its own can be retained
+		return false
+	}
+	if config != nil && config.RetainOnFailure {
+		return true
+	}
+	retain, _ := strconv.ParseBool(os.Getenv(RetainOnFailureEnv))
+	return retain
+}
+
 // createTemplateDatabase creates a template database from the main database
-func createTemplateDatabase(ctx context.Context, adminDB *sql.DB, sourceDBName string, templateDBName string) error {
+func createTemplateDatabase(ctx context.Context, adminDB *sql.DB, sourceDBName string, templateDBName string, options *CreateOptions) error {
 	log.Printf("Attempting to create template database '%s' from source '%s'", templateDBName, sourceDBName)
 	// Terminate all connections to the source database before creating template
-	_, err := adminDB.ExecContext(ctx, fmt.Sprintf(`
-		SELECT pg_terminate_backend(pid)
-		FROM pg_stat_activity
-		WHERE datname = '%s' AND pid <> pg_backend_pid()
-	`, sourceDBName))
-	if err != nil {
+	if err := terminateConnections(ctx, adminDB, sourceDBName); err != nil {
 		log.Printf("Warning: failed to terminate connections to source database: %v", err)
 	}
 
+	return createDatabaseIfNotExists(ctx, adminDB, sourceDBName, templateDBName, options)
+}
+
+// createDatabaseIfNotExists creates the template database from the source database,
+// treating a template database that already exists as success
+func createDatabaseIfNotExists(ctx context.Context, adminDB *sql.DB, sourceDBName string, templateDBName string, options *CreateOptions) error {
 	// Try to create the database first, then handle conflicts
 	// This is more atomic than check-then-create
-	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s" TEMPLATE "%s"`, templateDBName, sourceDBName))
+	_, err := adminDB.ExecContext(ctx, `CREATE DATABASE `+quoteIdentifier(templateDBName)+` TEMPLATE `+quoteIdentifier(sourceDBName)+options.clause())
 	if err == nil {
 		log.Printf("Created template database '%s'", templateDBName)
 		return nil
 	}
 
-	// Handle various race condition scenarios
-	errStr := strings.ToLower(err.Error())
-	if strings.Contains(errStr, "already exists") ||
-		strings.Contains(errStr, "duplicate key value violates unique constraint") ||
-		strings.Contains(errStr, "pg_database_datname_index") {
+	// Another process created it concurrently. Racing CREATE DATABASE statements can
+	// also fail on the unique index of pg_database instead of reporting a duplicate.
+	switch errorCode(err) {
+	case codeDuplicateDatabase, codeUniqueViolation:
 		log.Printf("Template database '%s' already exists (race condition)", templateDBName)
 		return nil
 	}
 
-	// If it's not a race condition, check if the database actually exists now
-	// This handles edge cases where the error message might be different
-	var exists bool
-	checkErr := adminDB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)", templateDBName).Scan(&exists)
-	if checkErr == nil && exists {
-		log.Printf("Template database '%s' already exists (verified after error)", templateDBName)
-		return nil
-	}
-
 	// If we get here, it's a real error
-	return fmt.Errorf("failed to create template database: %w", err)
+	return fmt.Errorf("failed to create template database: %w", &DatabaseError{Op: OpCreate, Database: templateDBName, Err: err})
 }
 
 // createTestDatabase creates a test database from the template
-func createTestDatabase(ctx context.Context, adminDB *sql.DB, templateDBName, testDBName string) (*sql.DB, error) {
+func createTestDatabase(ctx context.Context, adminDB execer, templateDBName, testDBName string, options *CreateOptions) (*sql.DB, error) {
 	log.Printf("Attempting to create test database '%s' from template '%s'", testDBName, templateDBName)
 	// Create test database from template
-	_, err := adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s" TEMPLATE "%s"`, testDBName, templateDBName))
+	_, err := adminDB.ExecContext(ctx, `CREATE DATABASE `+quoteIdentifier(testDBName)+` TEMPLATE `+quoteIdentifier(templateDBName)+options.cloneClause())
 	if err != nil {
 		log.Printf("Failed to create test database: %v", err)
-		return nil, fmt.Errorf("failed to create test database: %w", err)
+		return nil, fmt.Errorf("failed to create test database: %w", &DatabaseError{Op: OpCreate, Database: testDBName, Err: err})
 	}
 
 	log.Printf("Created test database '%s' from template", testDBName)
@@ -248,25 +672,20 @@ func createTestDatabase(ctx context.Context, adminDB *sql.DB, templateDBName, te
 }
 
 // dropTestDatabase drops the test database
-func dropTestDatabase(ctx context.Context, adminDB *sql.DB, testDBName string) error {
+func dropTestDatabase(ctx context.Context, adminDB execer, testDBName string) error {
 	// Terminate all connections to the test database
-	_, err := adminDB.ExecContext(ctx, fmt.Sprintf(`
-		SELECT pg_terminate_backend(pid)
-		FROM pg_stat_activity
-		WHERE datname = '%s' AND pid <> pg_backend_pid()
-	`, testDBName))
-	if err != nil {
+	if err := terminateConnections(ctx, adminDB, testDBName); err != nil {
 		log.Printf("Warning: failed to terminate connections to test database: %v", err)
 	}
 
 	// Drop the test database
-	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`DROP DATABASE IF EXISTS "%s" WITH (FORCE)`, testDBName))
+	_, err := adminDB.ExecContext(ctx, `DROP DATABASE IF EXISTS `+quoteIdentifier(testDBName)+` WITH (FORCE)`)
+	if errorCode(err) == codeSyntaxError {
+		// Fallback for PostgreSQL < 13, which does not know WITH (FORCE)
+		_, err = adminDB.ExecContext(ctx, `DROP DATABASE IF EXISTS `+quoteIdentifier(testDBName))
+	}
 	if err != nil {
-		// Fallback for PostgreSQL < 13
-		_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, testDBName))
-		if err != nil {
-			return fmt.Errorf("failed to drop test database: %w", err)
-		}
+		return fmt.Errorf("failed to drop test database: %w", &DatabaseError{Op: OpDrop, Database: testDBName, Err: err})
 	}
 
 	return nil
@@ -274,77 +693,115 @@ func dropTestDatabase(ctx context.Context, adminDB *sql.DB, testDBName string) e
 
 var dbNameCounter int64
 
+// maxIdentifierLength is the maximum length in bytes of a PostgreSQL identifier (NAMEDATALEN - 1)
+const maxIdentifierLength = 63
+
 // generateUniqueDBName generates a unique database name
 func generateUniqueDBName(prefix string) string {
+	return prefix + uniqueDBNameSuffix()
+}
+
+// generateTestDBName generates a unique database name that embeds the sanitized
+// test name between the prefix and the unique suffix, truncating the test name
+// so that the result fits into a PostgreSQL identifier.
+func generateTestDBName(prefix, testName string) string {
+	suffix := uniqueDBNameSuffix()
+	name := sanitizeIdentifier(testName)
+
+	available := maxIdentifierLength - len(prefix) - len(suffix) - 1
+	if available <= 0 || name == "" {
+		return prefix + suffix
+	}
+	if len(name) > available {
+		name = strings.TrimRight(name[:available], "_")
+	}
+	return prefix + name + "_" + suffix
+}
+
+// uniqueDBNameSuffix returns the "<nanos>_<pid>_<seq>" part of generated database names
+func uniqueDBNameSuffix() string {
 	timestamp := time.Now().UnixNano()
 	pid := os.Getpid()
 	seq := atomic.AddInt64(&dbNameCounter, 1)
-	return fmt.Sprintf("%s%d_%d_%d", prefix, timestamp, pid, seq)
+	return fmt.Sprintf("%d_%d_%d", timestamp, pid, seq)
+}
+
+// sanitizeIdentifier lowercases s and replaces every character that is not
+// a letter, digit or underscore with an underscore, collapsing repeats.
+func sanitizeIdentifier(s string) string {
+	var b strings.Builder
+	lastUnderscore := true
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			lastUnderscore = false
+			continue
+		}
+		if !lastUnderscore {
+			b.WriteByte('_')
+			lastUnderscore = true
+		}
+	}
+	return strings.TrimRight(b.String(), "_")
 }
 
 // ReplaceDBName replaces the database name in a connection string
 func ReplaceDBName(connStr, newDBName string) string {
-	// Try parsing as DSN first if it contains key=value but is not a URL
-	if strings.Contains(connStr, "=") && !strings.HasPrefix(connStr, "postgres://") && !strings.HasPrefix(connStr, "postgresql://") {
-		parts := strings.Split(connStr, " ")
-		hasDbname := false
+	c, err := ParseConnString(connStr)
+	if err != nil {
+		// Fallback to simple query appending if parse failed
+		if strings.Contains(connStr, "?") {
+			return connStr + "&dbname=" + newDBName
+		}
+		return connStr + "?dbname=" + newDBName
+	}
+
+	c.Set("dbname", newDBName)
+	return c.String()
+}
+
+// RedactPassword replaces the password in a connection string with "xxxxx".
+// Supports URL formats and DSN formats with password=...
+func RedactPassword(connStr string) string {
+	c, err := ParseConnString(connStr)
+	if err != nil {
+		// Unparseable connection strings may still contain a password
+		parts := strings.Fields(connStr)
 		for i, part := range parts {
-			if strings.HasPrefix(part, "dbname=") {
-				parts[i] = "dbname=" + newDBName
-				hasDbname = true
-				break
+			if strings.HasPrefix(part, "password=") {
+				parts[i] = "password=xxxxx"
 			}
 		}
-		if !hasDbname {
-			parts = append(parts, "dbname="+newDBName)
-		}
 		return strings.Join(parts, " ")
 	}
 
-	// Parse as URL
-	if u, err := url.Parse(connStr); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
-		u.Path = "/" + newDBName
-		// Remove dbname from query string to avoid conflicts
-		q := u.Query()
-		q.Del("dbname")
-		u.RawQuery = q.Encode()
-		return u.String()
+	if _, ok := c.Get("password"); ok {
+		c.Set("password", "xxxxx")
 	}
+	return c.String()
+}
 
-	// Fallback to simple query appending if parse failed
-	if strings.Contains(connStr, "?") {
-		return connStr + "&dbname=" + newDBName
+// withConnParam sets a connection parameter in a connection string.
+// Supports URL formats and DSN formats.
+func withConnParam(connStr, key, value string) string {
+	c, err := ParseConnString(connStr)
+	if err != nil {
+		return connStr + " " + key + "=" + quoteConnValue(value)
 	}
-	return connStr + "?dbname=" + newDBName
+
+	c.Set(key, value)
+	return c.String()
 }
 
 // ExtractDBName tries to determine the database name from a connection string.
 // Supports URL formats like postgres://.../<db> and DSN formats with dbname=...
+// It does not consider PGDATABASE or other defaults.
 func ExtractDBName(connStr string) string {
-	// URL format
-	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
-		if u, err := url.Parse(connStr); err == nil {
-			// Check query param dbname if present first
-			if dbname := u.Query().Get("dbname"); dbname != "" {
-				return dbname
-			}
-			// Path is like /main_db
-			p := strings.TrimPrefix(u.Path, "/")
-			if p != "" {
-				return p
-			}
-		}
-	}
-
-	// DSN format
-	if strings.Contains(connStr, "dbname=") {
-		parts := strings.Split(connStr, " ")
-		for _, part := range parts {
-			if strings.HasPrefix(part, "dbname=") {
-				return strings.TrimPrefix(part, "dbname=")
-			}
-		}
+	c, err := ParseConnString(connStr)
+	if err != nil {
+		return ""
 	}
 
-	return ""
+	dbName, _ := c.Get("dbname")
+	return dbName
 }
@@ -201,6 +201,162 @@ func TestSandboxWithDependencyInjection(t *testing.T) {
 	assert.Equal(t, user.Email, foundUser.Email)
 }
 
+func TestNewT(t *testing.T) {
+	mainDBURL := getTestDBURL()
+
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	config := &Config{
+		TemplateDBName:    "template_test",
+		TestDBPrefix:      "test_t_",
+		MaxConnections:    5,
+		ConnectionTimeout: 10 * time.Second,
+	}
+
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			sandbox := NewT(t, mainDBURL, config)
+			assert.Contains(t, sandbox.DBName, "test_t_testnewt_"+name+"_")
+
+			var currentDB string
+			err := sandbox.DB().QueryRow("SELECT current_database()").Scan(&currentDB)
+			require.NoError(t, err)
+			assert.Equal(t, sandbox.DBName, currentDB)
+		})
+	}
+}
+
+func TestSandboxMigrateTemplate(t *testing.T) {
+	mainDBURL := getTestDBURL()
+
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	config := &Config{
+		TemplateDBName:    "template_migrated_test",
+		TestDBPrefix:      "test_migrated_",
+		MaxConnections:    5,
+		ConnectionTimeout: 10 * time.Second,
+		MigrateTemplate:   true,
+	}
+
+	adminDB, err := sql.Open("postgres", ReplaceDBName(mainDBURL, "postgres"))
+	require.NoError(t, err)
+	defer adminDB.Close()
+	require.NoError(t, dropTestDatabase(context.Background(), adminDB, config.TemplateDBName))
+	defer dropTestDatabase(context.Background(), adminDB, config.TemplateDBName)
+
+	// The checker migrates whatever database it is given
+	var migratedURLs []string
+	checker := NewCustomMigrationChecker(func(dbURL string) error {
+		migratedURLs = append(migratedURLs, dbURL)
+		db, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS migrated_template_marker (id INT)")
+		return err
+	})
+
+	sandbox, err := NewWithMigrationChecker(mainDBURL, config, checker)
+	require.NoError(t, err)
+	defer sandbox.Close()
+
+	require.Equal(t, []string{ReplaceDBName(mainDBURL, config.TemplateDBName)}, migratedURLs)
+
+	var inSandbox bool
+	require.NoError(t, sandbox.DB().QueryRow("SELECT to_regclass('migrated_template_marker') IS NOT NULL").Scan(&inSandbox))
+	assert.True(t, inSandbox)
+
+	mainDB, err := sql.Open("postgres", mainDBURL)
+	require.NoError(t, err)
+	defer mainDB.Close()
+
+	var inMain bool
+	require.NoError(t, mainDB.QueryRow("SELECT to_regclass('migrated_template_marker') IS NOT NULL").Scan(&inMain))
+	assert.False(t, inMain)
+}
+
+func TestSandboxMigrateTemplateOpenConnections(t *testing.T) {
+	mainDBURL := getTestDBURL()
+
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	config := DefaultConfig()
+	config.TemplateDBName = "template_migrated_open_test"
+	config.TestDBPrefix = "test_migrated_"
+	config.MigrateTemplate = true
+	config.CloneRetries = 0
+
+	adminDB, err := sql.Open("postgres", ReplaceDBName(mainDBURL, "postgres"))
+	require.NoError(t, err)
+	defer adminDB.Close()
+	require.NoError(t, dropTestDatabase(context.Background(), adminDB, config.TemplateDBName))
+	defer dropTestDatabase(context.Background(), adminDB, config.TemplateDBName)
+
+	// A checker that keeps its connection pool open does not keep the template busy
+	var leaked *sql.DB
+	defer func() {
+		if leaked != nil {
+			leaked.Close()
+		}
+	}()
+	checker := NewCustomMigrationChecker(func(dbURL string) error {
+		db, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			return err
+		}
+		leaked = db
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS migrated_template_marker (id INT)")
+		return err
+	})
+
+	sandbox, err := NewWithMigrationChecker(mainDBURL, config, checker)
+	require.NoError(t, err)
+	require.NoError(t, sandbox.Close())
+}
+
+func TestSandboxAdminURL(t *testing.T) {
+	mainDBURL := getTestDBURL()
+
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	for name, config := range map[string]*Config{
+		"admin URL":      {AdminURL: ReplaceDBName(mainDBURL, "template1")},
+		"maintenance DB": {MaintenanceDB: "template1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config.TemplateDBName = "template_test"
+			config.TestDBPrefix = "test_admin_"
+
+			sandbox, err := New(mainDBURL, config)
+			require.NoError(t, err)
+			defer sandbox.Close()
+
+			var currentDB string
+			require.NoError(t, sandbox.DB().QueryRow("SELECT current_database()").Scan(&currentDB))
+			assert.Equal(t, sandbox.DBName, currentDB)
+		})
+	}
+
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_admin_"
+	config.MaintenanceDB = "sql_sandbox_missing"
+	_, err := New(mainDBURL, config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "admin database")
+}
+
 // Example service demonstrating dependency injection
 type User struct {
 	ID        int
@@ -0,0 +1,111 @@
+package sql_sandbox
+
+import (
+	"context"
+	"testing"
+)
+
+// NewT creates a new sandbox bound to the given test. The test database is named
+// after t.Name(), setup errors fail the test immediately and the sandbox is closed
+// automatically through t.Cleanup. When retention on failure is enabled (see
+// Config.RetainOnFailure) the database of a failed test is kept and a psql
+// command to connect to it is logged.
+func NewT(t testing.TB, mainDBURL string, config *Config) *Sandbox {
+	t.Helper()
+	return NewTWithMigrationCheckerAndContext(context.Background(), t, mainDBURL, config, nil)
+}
+
+// NewTWithContext creates a new sandbox bound to the given test with context
+func NewTWithContext(ctx context.Context, t testing.TB, mainDBURL string, config *Config) *Sandbox {
+	t.Helper()
+	return NewTWithMigrationCheckerAndContext(ctx, t, mainDBURL, config, nil)
+}
+
+// NewTWithMigrationChecker creates a new sandbox bound to the given test with a custom migration checker
+func NewTWithMigrationChecker(t testing.TB, mainDBURL string, config *Config, migrationChecker MigrationChecker) *Sandbox {
+	t.Helper()
+	return NewTWithMigrationCheckerAndContext(context.Background(), t, mainDBURL, config, migrationChecker)
+}
+
+// NewTWithMigrationCheckerAndContext creates a new sandbox bound to the given test
+// with a custom migration checker and context
+func NewTWithMigrationCheckerAndContext(ctx context.Context, t testing.TB, mainDBURL string, config *Config, migrationChecker MigrationChecker) *Sandbox {
+	t.Helper()
+
+	// Work on a copy so that parallel tests sharing one config do not race on it
+	cfg := DefaultConfig()
+	if config != nil {
+		copied := *config
+		cfg = &copied
+	}
+
+	sandbox, err := newSandbox(ctx, mainDBURL, cfg, migrationChecker, t.Name())
+	if err != nil {
+		t.Fatalf("sql_sandbox: failed to create sandbox: %v", err)
+	}
+
+	closeWithTest(t, sandbox)
+	return sandbox
+}
+
+// NewT creates a new sandbox bound to the given test like the package-level NewT,
+// over the admin connection pool of the manager
+func (m *Manager) NewT(t testing.TB) *Sandbox {
+	t.Helper()
+	return m.NewTWithContext(context.Background(), t)
+}
+
+// NewTWithContext creates a new sandbox bound to the given test with context
+func (m *Manager) NewTWithContext(ctx context.Context, t testing.TB) *Sandbox {
+	t.Helper()
+
+	sandbox, err := m.newManagedSandbox(ctx, t.Name())
+	if err != nil {
+		t.Fatalf("sql_sandbox: failed to create sandbox: %v", err)
+	}
+
+	closeWithTest(t, sandbox)
+	return sandbox
+}
+
+// closeWithTest closes the sandbox when the test completes, or retains its database
+// if the test failed and retention on failure is enabled
+func closeWithTest(t testing.TB, sandbox *Sandbox) {
+	sandbox.testCleanup = t.Cleanup
+	t.Cleanup(func() {
+		if t.Failed() && shouldRetainOnFailure(sandbox.Config) {
+			connStr, err := sandbox.retain(context.Background(), t.Name())
+			if err != nil {
+				t.Errorf("sql_sandbox: failed to retain sandbox %s: %v", sandbox.DBName, err)
+				return
+			}
+			t.Logf("sql_sandbox: retained database %s of failed test, connect with: psql '%s'", sandbox.DBName, connStr)
+			return
+		}
+
+		if err := sandbox.Close(); err != nil {
+			t.Errorf("sql_sandbox: failed to close sandbox %s: %v", sandbox.DBName, err)
+		}
+	})
+}
+
+// NewChild forks the parent sandbox for the given test, typically a subtest of the test
+// owning the parent, so that it starts from the state the parent test built. The child
+// database is named after t.Name() and closed through t.Cleanup like with NewT.
+func NewChild(t testing.TB, parent *Sandbox) *Sandbox {
+	t.Helper()
+	return NewChildWithContext(context.Background(), t, parent)
+}
+
+// NewChildWithContext forks the parent sandbox for the given test with context
+func NewChildWithContext(ctx context.Context, t testing.TB, parent *Sandbox) *Sandbox {
+	t.Helper()
+
+	child, err := parent.fork(ctx, t.Name())
+	if err != nil {
+		t.Fatalf("sql_sandbox: failed to fork sandbox: %v", err)
+	}
+
+	closeWithTest(t, child)
+	return child
+}
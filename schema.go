@@ -0,0 +1,252 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// newSchemaSandbox creates a sandbox in a new schema of the main database, cloned from
+// the template schema. It does not need the CREATEDB privilege.
+func (m *Manager) newSchemaSandbox(ctx context.Context, testName string) (*Sandbox, error) {
+	config := m.config
+	mainDB := m.adminDB
+
+	if err := m.ensureSchemaSetup(ctx); err != nil {
+		return nil, err
+	}
+
+	// Generate unique test schema name
+	schemaName := generateUniqueDBName(config.TestDBPrefix)
+	if testName != "" {
+		schemaName = generateTestDBName(config.TestDBPrefix, testName)
+	}
+
+	if err := cloneSchema(ctx, mainDB, templateSchemaName(config), schemaName); err != nil {
+		return nil, fmt.Errorf("failed to create test schema: %w", err)
+	}
+
+	testDBConn, err := openTestDBConnStr(ctx, config, schemaConnString(config, schemaName))
+	if err != nil {
+		if dropErr := dropTestSchema(context.Background(), mainDB, schemaName); dropErr != nil {
+			log.Printf("Warning: failed to drop test schema: %v", dropErr)
+		}
+		return nil, err
+	}
+
+	return &Sandbox{
+		TestDB: testDBConn,
+		DBName: connDBName(config.MainDBURL),
+		Schema: schemaName,
+		Config: config,
+	}, nil
+}
+
+// ensureSchemaSetup migrates the main database once per database and template schema
+func (m *Manager) ensureSchemaSetup(ctx context.Context) error {
+	setupKey := m.config.MainDBURL + "|schema:" + templateSchemaName(m.config)
+	stateAny, _ := m.setupMap.LoadOrStore(setupKey, &setupState{})
+	state := stateAny.(*setupState)
+
+	state.once.Do(func() {
+		if err := m.migrationChecker.EnsureMigratedWithContext(ctx, m.config.MainDBURL); err != nil {
+			state.err = fmt.Errorf("failed to ensure main DB is migrated: %w", err)
+		}
+	})
+
+	return state.err
+}
+
+// templateSchemaName returns the schema cloned into every sandbox, defaults to public
+func templateSchemaName(config *Config) string {
+	if config.TemplateSchema == "" {
+		return "public"
+	}
+	return config.TemplateSchema
+}
+
+// cloneSchema copies sequences, tables with their data, column defaults, foreign keys
+// and views from the source schema into a new target schema. Other objects such as
+// functions, types and triggers are not copied; the cloned tables keep referencing
+// the types of the source schema.
+func cloneSchema(ctx context.Context, db *sql.DB, source, target string) error {
+	log.Printf("Attempting to create test schema '%s' from schema '%s'", target, source)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `CREATE SCHEMA `+quoteIdentifier(target)); err != nil {
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	// Definitions are rendered with the source schema on the search_path so that
+	// references to its objects are unqualified, and executed with the target schema
+	// first on the search_path so that they resolve to the cloned objects.
+	if _, err := tx.ExecContext(ctx, `SET LOCAL search_path TO `+quoteIdentifier(source)); err != nil {
+		return fmt.Errorf("failed to set search_path: %w", err)
+	}
+
+	sequences, err := queryStrings(ctx, tx, `
+		SELECT format('CREATE SEQUENCE %I AS %s INCREMENT BY %s MINVALUE %s MAXVALUE %s START WITH %s %s',
+			s.sequencename, s.data_type, s.increment_by, s.min_value, s.max_value, s.start_value,
+			CASE WHEN s.cycle THEN 'CYCLE' ELSE 'NO CYCLE' END)
+		FROM pg_sequences s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class c ON c.relname = s.sequencename AND c.relnamespace = n.oid
+		WHERE s.schemaname = $1
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype = 'i')
+		ORDER BY s.sequencename
+	`, source)
+	if err != nil {
+		return fmt.Errorf("failed to list sequences: %w", err)
+	}
+
+	tables, err := queryStrings(ctx, tx, `
+		SELECT c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind = 'r' AND NOT c.relispartition
+		ORDER BY c.relname
+	`, source)
+	if err != nil {
+		return fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	defaults, err := queryStrings(ctx, tx, `
+		SELECT format('ALTER TABLE %I ALTER COLUMN %I SET DEFAULT %s', c.relname, a.attname, pg_get_expr(d.adbin, d.adrelid))
+		FROM pg_attrdef d
+		JOIN pg_class c ON c.oid = d.adrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+		WHERE n.nspname = $1 AND c.relkind = 'r' AND NOT c.relispartition AND a.attgenerated = ''
+		ORDER BY c.relname, a.attnum
+	`, source)
+	if err != nil {
+		return fmt.Errorf("failed to list column defaults: %w", err)
+	}
+
+	copies, err := queryStrings(ctx, tx, `
+		SELECT format('INSERT INTO %I.%I (%s) OVERRIDING SYSTEM VALUE SELECT %s FROM %I.%I',
+			$2::text, c.relname, cols, cols, n.nspname, c.relname)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN LATERAL (
+			SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY a.attnum) AS cols
+			FROM pg_attribute a
+			WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = ''
+		) col_list
+		WHERE n.nspname = $1 AND c.relkind = 'r' AND NOT c.relispartition AND cols IS NOT NULL
+		ORDER BY c.relname
+	`, source, target)
+	if err != nil {
+		return fmt.Errorf("failed to list table data: %w", err)
+	}
+
+	// Identity sequences are addressed through their column since their names are generated
+	sequenceValues, err := queryStrings(ctx, tx, `
+		SELECT CASE
+			WHEN c.oid IS NULL THEN format('SELECT setval(%L, %s, true)', quote_ident(s.sequencename), s.last_value)
+			ELSE format('SELECT setval(pg_get_serial_sequence(%L, %L), %s, true)', quote_ident(c.relname), a.attname, s.last_value)
+		END
+		FROM pg_sequences s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class sc ON sc.relname = s.sequencename AND sc.relnamespace = n.oid
+		LEFT JOIN pg_depend d ON d.objid = sc.oid AND d.deptype = 'i'
+		LEFT JOIN pg_class c ON c.oid = d.refobjid
+		LEFT JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE s.schemaname = $1 AND s.last_value IS NOT NULL
+		ORDER BY s.sequencename
+	`, source)
+	if err != nil {
+		return fmt.Errorf("failed to list sequence values: %w", err)
+	}
+
+	foreignKeys, err := queryStrings(ctx, tx, `
+		SELECT format('ALTER TABLE %I ADD CONSTRAINT %I %s', c.relname, con.conname, pg_get_constraintdef(con.oid))
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND con.contype = 'f' AND c.relkind = 'r' AND NOT c.relispartition
+		ORDER BY c.relname, con.conname
+	`, source)
+	if err != nil {
+		return fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+
+	views, err := queryStrings(ctx, tx, `
+		SELECT format('CREATE VIEW %I AS %s', c.relname, pg_get_viewdef(c.oid))
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind = 'v'
+		ORDER BY c.oid
+	`, source)
+	if err != nil {
+		return fmt.Errorf("failed to list views: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `SET LOCAL search_path TO `+quoteIdentifier(target)+`, `+quoteIdentifier(source)); err != nil {
+		return fmt.Errorf("failed to set search_path: %w", err)
+	}
+
+	var statements []string
+	statements = append(statements, sequences...)
+	for _, table := range tables {
+		statements = append(statements, `CREATE TABLE `+quoteIdentifier(target)+`.`+quoteIdentifier(table)+` (LIKE `+quoteIdentifier(source)+`.`+quoteIdentifier(table)+` INCLUDING ALL)`)
+	}
+	statements = append(statements, defaults...)
+	statements = append(statements, copies...)
+	statements = append(statements, sequenceValues...)
+	statements = append(statements, foreignKeys...)
+	statements = append(statements, views...)
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to execute %q: %w", statement, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit schema clone: %w", err)
+	}
+
+	log.Printf("Created test schema '%s' from schema '%s'", target, source)
+	return nil
+}
+
+// dropTestSchema drops the test schema with everything in it
+func dropTestSchema(ctx context.Context, db *sql.DB, schemaName string) error {
+	_, err := db.ExecContext(ctx, `DROP SCHEMA IF EXISTS `+quoteIdentifier(schemaName)+` CASCADE`)
+	if err != nil {
+		return fmt.Errorf("failed to drop test schema: %w", err)
+	}
+	return nil
+}
+
+// queryStrings returns the first column of all rows of the query
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+// schemaConnString returns the connection string of sandbox connections to a test schema,
+// with the configured settings as runtime parameters
+func schemaConnString(config *Config, schemaName string) string {
+	return withSettings(withConnParam(config.MainDBURL, "search_path", quoteIdentifier(schemaName)), config.Settings)
+}
@@ -0,0 +1,91 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandboxSchemaIsolation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	mainDBURL := getTestDBURL()
+	mainDB, err := sql.Open("postgres", mainDBURL)
+	require.NoError(t, err)
+	defer mainDB.Close()
+
+	// Prepare a template schema with a serial, an identity column, a foreign key and a view
+	_, err = mainDB.Exec(`
+		DROP SCHEMA IF EXISTS schema_template CASCADE;
+		CREATE SCHEMA schema_template;
+		CREATE TABLE schema_template.accounts (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
+		CREATE TABLE schema_template.orders (
+			id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			account_id INT NOT NULL REFERENCES schema_template.accounts(id)
+		);
+		CREATE VIEW schema_template.account_names AS SELECT name FROM schema_template.accounts;
+		INSERT INTO schema_template.accounts (name) VALUES ('seed');
+		INSERT INTO schema_template.orders (account_id) VALUES (1);
+	`)
+	require.NoError(t, err)
+	defer mainDB.Exec(`DROP SCHEMA IF EXISTS schema_template CASCADE`)
+
+	config := &Config{
+		TestDBPrefix:      "test_schema_",
+		MaxConnections:    5,
+		ConnectionTimeout: 10 * time.Second,
+		Isolation:         IsolationSchema,
+		TemplateSchema:    "schema_template",
+	}
+
+	sandbox, err := New(mainDBURL, config)
+	require.NoError(t, err)
+	require.NotEmpty(t, sandbox.Schema)
+
+	db := sandbox.DB()
+	var currentSchema string
+	require.NoError(t, db.QueryRow("SELECT current_schema()").Scan(&currentSchema))
+	assert.Equal(t, sandbox.Schema, currentSchema)
+
+	// Seed data is copied and sequences continue after it
+	var accountID, orderID int
+	require.NoError(t, db.QueryRow("INSERT INTO accounts (name) VALUES ('test') RETURNING id").Scan(&accountID))
+	assert.Equal(t, 2, accountID)
+	require.NoError(t, db.QueryRow("INSERT INTO orders (account_id) VALUES ($1) RETURNING id", accountID).Scan(&orderID))
+	assert.Equal(t, 2, orderID)
+
+	// Foreign keys point at the cloned table
+	_, err = db.Exec("INSERT INTO orders (account_id) VALUES (42)")
+	require.Error(t, err)
+
+	var names int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM account_names").Scan(&names))
+	assert.Equal(t, 2, names)
+
+	// The template schema is untouched
+	var templateAccounts int
+	require.NoError(t, mainDB.QueryRow("SELECT count(*) FROM schema_template.accounts").Scan(&templateAccounts))
+	assert.Equal(t, 1, templateAccounts)
+
+	schema := sandbox.Schema
+	require.NoError(t, sandbox.Close())
+
+	var exists bool
+	require.NoError(t, mainDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = $1)", schema).Scan(&exists))
+	assert.False(t, exists)
+
+	// Closing again is a no-op and keeps the main database
+	require.NoError(t, sandbox.Close())
+	require.NoError(t, mainDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)", sandbox.DBName).Scan(&exists))
+	assert.True(t, exists)
+
+	// Nor is the main database cloned for a fork
+	_, err = sandbox.Fork(context.Background())
+	assert.ErrorContains(t, err, "sandbox is closed")
+}
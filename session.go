@@ -0,0 +1,215 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+)
+
+// As returns a connection pool to the sandbox database whose sessions run as role with
+// the given settings applied with set_config, e.g. to test row-level security policies
+// keyed on current_setting('app.tenant_id'). An empty role keeps the connecting user.
+// Role and settings are restored every time a connection is reused, even if the test
+// changed them. The pool may be closed by the caller and is closed together with the
+// sandbox otherwise. It is not available with IsolationTransaction.
+func (s *Sandbox) As(ctx context.Context, role string, settings map[string]string) (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	connStr, err := s.connString("session pools")
+	if err != nil {
+		return nil, err
+	}
+	connector, err := newConnector(s.Config, connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to test database: %w", err)
+	}
+
+	db := sql.OpenDB(&sessionConnector{connector: connector, setup: sessionSetup(role, settings)})
+	db.SetMaxOpenConns(s.Config.MaxConnections)
+	db.SetConnMaxLifetime(s.Config.ConnectionTimeout)
+
+	// Test the connection with context, this also applies role and settings
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping test database as %q: %w", role, err)
+	}
+
+	s.sessionDBs = append(s.sessionDBs, db)
+	return db, nil
+}
+
+// sessionSetup returns the statements that switch a session to role and apply settings
+func sessionSetup(role string, settings map[string]string) []string {
+	var setup []string
+	if role != "" {
+		setup = append(setup, "SET ROLE "+quoteIdentifier(role))
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		setup = append(setup, "SELECT set_config("+quoteLiteral(name)+", "+quoteLiteral(settings[name])+", false)")
+	}
+	return setup
+}
+
+// closeSessions closes the pools returned by As
+func (s *Sandbox) closeSessions() error {
+	var err error
+	for _, db := range s.sessionDBs {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close session pool: %w", closeErr)
+		}
+	}
+	s.sessionDBs = nil
+	return err
+}
+
+// sessionConnector applies role and settings to every connection it opens
+type sessionConnector struct {
+	connector driver.Connector
+	setup     []string
+}
+
+// Connect implements driver.Connector
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &sessionConn{inner: inner, setup: c.setup}
+	if err := conn.apply(ctx); err != nil {
+		inner.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Driver implements driver.Connector
+func (c *sessionConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// sessionConn wraps a driver connection whose session runs with a role and settings
+type sessionConn struct {
+	inner driver.Conn
+	setup []string
+}
+
+// apply runs the setup statements on the connection
+func (c *sessionConn) apply(ctx context.Context) error {
+	execer, ok := c.inner.(driver.ExecerContext)
+	if !ok {
+		return fmt.Errorf("driver does not support ExecContext")
+	}
+	for _, stmt := range c.setup {
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			return fmt.Errorf("failed to apply session settings: %w", err)
+		}
+	}
+	return nil
+}
+
+// Prepare implements driver.Conn
+func (c *sessionConn) Prepare(query string) (driver.Stmt, error) {
+	return c.inner.Prepare(query)
+}
+
+// PrepareContext implements driver.ConnPrepareContext
+func (c *sessionConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.inner.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.inner.Prepare(query)
+}
+
+// Close implements driver.Conn
+func (c *sessionConn) Close() error {
+	return c.inner.Close()
+}
+
+// Begin implements driver.Conn
+func (c *sessionConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx implements driver.ConnBeginTx
+func (c *sessionConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.inner.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return nil, fmt.Errorf("driver does not support BeginTx")
+}
+
+// ExecContext implements driver.ExecerContext
+func (c *sessionConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.inner.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+// QueryContext implements driver.QueryerContext
+func (c *sessionConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.inner.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+// CheckNamedValue implements driver.NamedValueChecker
+func (c *sessionConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.inner.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// Ping implements driver.Pinger
+func (c *sessionConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.inner.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter. It discards whatever settings the
+// previous user of the connection changed and applies role and settings again.
+func (c *sessionConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.inner.(driver.SessionResetter); ok {
+		if err := resetter.ResetSession(ctx); err != nil {
+			return err
+		}
+	}
+
+	execer, ok := c.inner.(driver.ExecerContext)
+	if !ok {
+		return driver.ErrBadConn
+	}
+	for _, stmt := range []string{"RESET ROLE", "RESET ALL"} {
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			return driver.ErrBadConn
+		}
+	}
+	if err := c.apply(ctx); err != nil {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator
+func (c *sessionConn) IsValid() bool {
+	if validator, ok := c.inner.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionSetup(t *testing.T) {
+	assert.Empty(t, sessionSetup("", nil))
+	assert.Equal(t, []string{
+		`SET ROLE "tenant role"`,
+		`SELECT set_config('app.tenant_id', '42', false)`,
+		`SELECT set_config('app.user', 'o''brien', false)`,
+	}, sessionSetup("tenant role", map[string]string{"app.user": "o'brien", "app.tenant_id": "42"}))
+}
+
+func TestSessionConnector(t *testing.T) {
+	var statements []string
+	inner := &recordingConn{statements: &statements}
+	recorder := &recordingConnector{conn: inner}
+	connector := &sessionConnector{connector: recorder, setup: sessionSetup("tenant", map[string]string{"app.tenant_id": "1"})}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+
+	_, err := db.Exec("SELECT 1")
+	require.NoError(t, err)
+	_, err = db.Exec("SELECT 2")
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+	assert.True(t, inner.closed)
+	assert.Equal(t, 1, recorder.connects)
+	assert.Equal(t, []string{
+		`SET ROLE "tenant"`,
+		`SELECT set_config('app.tenant_id', '1', false)`,
+		"SELECT 1",
+		"RESET ROLE",
+		"RESET ALL",
+		`SET ROLE "tenant"`,
+		`SELECT set_config('app.tenant_id', '1', false)`,
+		"SELECT 2",
+	}, statements)
+}
+
+func TestSandboxAs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	mainDBURL := getTestDBURL()
+
+	adminDB, err := sql.Open("postgres", ReplaceDBName(mainDBURL, "postgres"))
+	require.NoError(t, err)
+	defer adminDB.Close()
+	_, err = adminDB.ExecContext(ctx, `DO $$ BEGIN
+		IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'sandbox_tenant') THEN
+			CREATE ROLE sandbox_tenant NOLOGIN;
+		END IF;
+	END $$`)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_as_"
+	sandbox, err := New(mainDBURL, config)
+	require.NoError(t, err)
+
+	for _, stmt := range []string{
+		"CREATE TABLE tenant_items (tenant_id int, name text)",
+		"INSERT INTO tenant_items VALUES (1, 'a'), (1, 'b'), (2, 'c')",
+		"ALTER TABLE tenant_items ENABLE ROW LEVEL SECURITY",
+		"CREATE POLICY tenant_isolation ON tenant_items USING (tenant_id = current_setting('app.tenant_id')::int)",
+		"GRANT SELECT ON tenant_items TO sandbox_tenant",
+	} {
+		_, err := sandbox.DB().ExecContext(ctx, stmt)
+		require.NoError(t, err, stmt)
+	}
+
+	countAs := func(db *sql.DB) int {
+		var count int
+		require.NoError(t, db.QueryRowContext(ctx, "SELECT count(*) FROM tenant_items").Scan(&count))
+		return count
+	}
+
+	tenant1, err := sandbox.As(ctx, "sandbox_tenant", map[string]string{"app.tenant_id": "1"})
+	require.NoError(t, err)
+	tenant2, err := sandbox.As(ctx, "sandbox_tenant", map[string]string{"app.tenant_id": "2"})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, countAs(tenant1))
+	assert.Equal(t, 1, countAs(tenant2))
+	assert.Equal(t, 3, countAs(sandbox.DB()))
+
+	var currentUser string
+	require.NoError(t, tenant1.QueryRowContext(ctx, "SELECT current_user").Scan(&currentUser))
+	assert.Equal(t, "sandbox_tenant", currentUser)
+
+	// Changes made by a test are undone when the connection is reused
+	tenant1.SetMaxOpenConns(1)
+	_, err = tenant1.ExecContext(ctx, "SELECT set_config('app.tenant_id', '2', false)")
+	require.NoError(t, err)
+	assert.Equal(t, 2, countAs(tenant1))
+
+	require.NoError(t, sandbox.Close())
+	assert.Error(t, tenant1.PingContext(ctx))
+}
+
+func TestSandboxAsTransactionIsolation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	config := DefaultConfig()
+	config.TestDBPrefix = "test_as_tx_"
+	config.Isolation = IsolationTransaction
+
+	sandbox := NewT(t, getTestDBURL(), config)
+	_, err := sandbox.As(context.Background(), "", map[string]string{"app.tenant_id": "1"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "IsolationTransaction")
+}
@@ -0,0 +1,159 @@
+package sql_sandbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// listQuoteSettings are the settings whose values are lists of identifiers, e.g.
+// search_path = '"$user", public'. Their elements are quoted as identifiers.
+var listQuoteSettings = map[string]bool{
+	"search_path":               true,
+	"temp_tablespaces":          true,
+	"session_preload_libraries": true,
+	"local_preload_libraries":   true,
+}
+
+// validateSettings checks the configured session defaults before any of them is sent
+// to the server
+func validateSettings(config *Config) error {
+	for name, value := range config.Settings {
+		if _, err := setClause(name, value); err != nil {
+			return err
+		}
+	}
+
+	// Databases owned by another role cannot be altered by an admin that is not a member of it
+	if len(config.Settings) > 0 && config.Isolation != IsolationSchema &&
+		config.CreateOptions != nil && config.CreateOptions.Owner != "" {
+		return fmt.Errorf("settings are not supported with CreateOptions.Owner, clear Config.Settings or set them on the owner with ALTER ROLE ... SET")
+	}
+	return nil
+}
+
+// applyDatabaseSettings sets the configured session defaults on a database with
+// ALTER DATABASE ... SET, so that every new connection to it inherits them
+func applyDatabaseSettings(ctx context.Context, adminDB execer, dbName string, settings map[string]string) error {
+	for _, name := range sortedSettings(settings) {
+		clause, err := setClause(name, settings[name])
+		if err != nil {
+			return err
+		}
+		if _, err := adminDB.ExecContext(ctx, `ALTER DATABASE `+quoteIdentifier(dbName)+` `+clause); err != nil {
+			return fmt.Errorf("failed to set %s on database %q: %w", name, dbName, err)
+		}
+	}
+	return nil
+}
+
+// withSettings adds the configured session defaults to a connection string as runtime
+// parameters, for sandboxes that do not have a database of their own. A search_path
+// already set in the connection string is kept.
+func withSettings(connStr string, settings map[string]string) string {
+	for _, name := range sortedSettings(settings) {
+		if strings.EqualFold(name, "search_path") {
+			continue
+		}
+		connStr = withConnParam(connStr, name, settings[name])
+	}
+	return connStr
+}
+
+// sortedSettings returns the names of the settings in a stable order
+func sortedSettings(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setClause returns the SET clause for a setting, quoting its name and value
+func setClause(name, value string) (string, error) {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if err := validateIdentifier("setting name", part); err != nil {
+			return "", err
+		}
+		parts[i] = quoteIdentifier(part)
+	}
+
+	if strings.ContainsRune(value, 0) {
+		return "", fmt.Errorf("value of setting %s must not contain NUL characters", name)
+	}
+	quoted := quoteLiteral(value)
+	if listQuoteSettings[strings.ToLower(name)] {
+		elements, err := splitIdentifierList(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid value of setting %s: %w", name, err)
+		}
+		for i, element := range elements {
+			elements[i] = quoteIdentifier(element)
+		}
+		quoted = strings.Join(elements, ", ")
+		if quoted == "" {
+			quoted = "''"
+		}
+	}
+
+	return `SET ` + strings.Join(parts, ".") + ` TO ` + quoted, nil
+}
+
+// splitIdentifierList splits a comma-separated list of identifiers the way PostgreSQL
+// reads search_path: unquoted identifiers are folded to lower case and double-quoted
+// ones are taken literally
+func splitIdentifierList(value string) ([]string, error) {
+	var elements []string
+	rest := strings.TrimSpace(value)
+	if rest == "" {
+		return nil, nil
+	}
+
+	for {
+		var element string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for {
+				end := strings.IndexByte(rest[i:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated quoted identifier in %q", value)
+				}
+				b.WriteString(rest[i : i+end])
+				i += end + 1
+				if i < len(rest) && rest[i] == '"' {
+					b.WriteByte('"')
+					i++
+					continue
+				}
+				break
+			}
+			element, rest = b.String(), strings.TrimSpace(rest[i:])
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			element = strings.ToLower(strings.TrimSpace(rest[:end]))
+			rest = rest[end:]
+			if strings.ContainsAny(element, " \t\n\"") {
+				return nil, fmt.Errorf("invalid identifier %q in %q", element, value)
+			}
+		}
+		if element == "" {
+			return nil, fmt.Errorf("empty identifier in %q", value)
+		}
+		elements = append(elements, element)
+
+		if rest == "" {
+			return elements, nil
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("expected \",\" after identifier in %q", value)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
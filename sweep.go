@@ -0,0 +1,232 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SweepOptions configures which orphaned sandbox databases Sweep removes
+type SweepOptions struct {
+	// Prefix of the sandbox database names, defaults to DefaultConfig().TestDBPrefix
+	Prefix string
+	// MaxAge marks databases created longer ago than MaxAge as stale. Zero disables the age check.
+	MaxAge time.Duration
+	// CheckProcess marks databases whose owning process is no longer running on this
+	// host as stale. Only enable it when every test process using the server runs on this host.
+	CheckProcess bool
+	// IncludeRetained also removes databases retained after a test failure
+	IncludeRetained bool
+	// DryRun reports the stale databases without dropping them
+	DryRun bool
+	// Driver selects the database/sql driver, defaults to DriverPQ
+	Driver Driver
+}
+
+// SweptDatabase describes a stale sandbox database found by Sweep
+type SweptDatabase struct {
+	Name      string
+	CreatedAt time.Time
+	PID       int
+	Reason    string
+	// Checkpoint is set for databases saved by Sandbox.Checkpoint
+	Checkpoint bool
+}
+
+// Sweep drops sandbox databases left behind by test processes that never called Close,
+// e.g. because they were killed on timeout. adminURL must point to a database other
+// than the swept ones, typically the "postgres" maintenance database. It returns the
+// databases that were dropped, or that would be dropped when opts.DryRun is set.
+func Sweep(ctx context.Context, adminURL string, opts SweepOptions) ([]SweptDatabase, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultConfig().TestDBPrefix
+	}
+	if opts.MaxAge <= 0 && !opts.CheckProcess {
+		return nil, fmt.Errorf("sweep requires MaxAge or CheckProcess to be set")
+	}
+
+	adminDB, err := openDB(&Config{Driver: opts.Driver}, adminURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to admin database: %w", err)
+	}
+	defer adminDB.Close()
+
+	rows, err := adminDB.QueryContext(ctx, `
+		SELECT datname, COALESCE(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database
+		WHERE NOT datistemplate
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var stale []SweptDatabase
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, fmt.Errorf("failed to scan database name: %w", err)
+		}
+		if !strings.HasPrefix(name, opts.Prefix) {
+			continue
+		}
+		if !opts.IncludeRetained && strings.HasPrefix(comment, retainedCommentPrefix) {
+			continue
+		}
+
+		createdAt, pid, ok := parseDBNameSuffix(name)
+		if !ok {
+			continue
+		}
+
+		db := SweptDatabase{Name: name, CreatedAt: createdAt, PID: pid, Checkpoint: isCheckpoint(comment)}
+		if db.Reason = staleReason(db, opts, now, processAlive); db.Reason != "" {
+			stale = append(stale, db)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	if opts.DryRun {
+		for _, db := range stale {
+			log.Printf("Would drop stale sandbox %s '%s' (%s)", sweptKind(db), db.Name, db.Reason)
+		}
+		return stale, nil
+	}
+
+	// Sandbox roles are named like their database. Only existing ones are dropped, as
+	// DROP ROLE requires CREATEROLE even when the role does not exist.
+	roles, err := listRoles(ctx, adminDB, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var swept []SweptDatabase
+	var errs []string
+	for _, db := range stale {
+		if err := dropTestDatabase(ctx, adminDB, db.Name); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", db.Name, err))
+			continue
+		}
+		if roles[db.Name] {
+			if err := dropSandboxRole(ctx, adminDB, db.Name); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", db.Name, err))
+			}
+		}
+		log.Printf("Dropped stale sandbox %s '%s' (%s)", sweptKind(db), db.Name, db.Reason)
+		swept = append(swept, db)
+	}
+
+	if len(errs) > 0 {
+		return swept, fmt.Errorf("errors during sweep: %s", strings.Join(errs, "; "))
+	}
+
+	return swept, nil
+}
+
+// isCheckpoint reports whether the database was saved by Sandbox.Checkpoint by its
+// comment; names do not tell, as test names may start with "checkpoint" as well
+func isCheckpoint(comment string) bool {
+	return strings.HasPrefix(comment, checkpointCommentPrefix)
+}
+
+// sweptKind names the kind of the swept database in log messages
+func sweptKind(db SweptDatabase) string {
+	if db.Checkpoint {
+		return "checkpoint database"
+	}
+	return "database"
+}
+
+// listRoles returns the names of the roles starting with prefix
+func listRoles(ctx context.Context, adminDB *sql.DB, prefix string) (map[string]bool, error) {
+	rows, err := adminDB.QueryContext(ctx, `SELECT rolname FROM pg_roles`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	defer rows.Close()
+
+	roles := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan role name: %w", err)
+		}
+		if strings.HasPrefix(name, prefix) {
+			roles[name] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	return roles, nil
+}
+
+// parseDBNameSuffix extracts the creation time and owning PID from the
+// "<nanos>_<pid>_<seq>" suffix of a generated database name
+func parseDBNameSuffix(name string) (time.Time, int, bool) {
+	parts := strings.Split(name, "_")
+	if len(parts) < 4 {
+		return time.Time{}, 0, false
+	}
+	parts = parts[len(parts)-3:]
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	pid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if _, err := strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return time.Unix(0, nanos), pid, true
+}
+
+// staleReason returns why the database is stale, or an empty string if it is not
+func staleReason(db SweptDatabase, opts SweepOptions, now time.Time, alive func(pid int) bool) string {
+	if opts.MaxAge > 0 {
+		if age := now.Sub(db.CreatedAt); age > opts.MaxAge {
+			return fmt.Sprintf("older than %s", opts.MaxAge)
+		}
+	}
+	if opts.CheckProcess && !alive(db.PID) {
+		return fmt.Sprintf("process %d is not running", db.PID)
+	}
+	return ""
+}
+
+// processAlive reports whether a process with the given PID is running on this host
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if pid == os.Getpid() {
+		return true
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Windows FindProcess already fails for processes that do not exist
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
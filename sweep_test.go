@@ -0,0 +1,179 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDBNameSuffix(t *testing.T) {
+	t.Run("generated name", func(t *testing.T) {
+		createdAt, pid, ok := parseDBNameSuffix(generateUniqueDBName("test_db_"))
+		require.True(t, ok)
+		assert.Equal(t, os.Getpid(), pid)
+		assert.WithinDuration(t, time.Now(), createdAt, time.Minute)
+	})
+
+	t.Run("test name", func(t *testing.T) {
+		_, pid, ok := parseDBNameSuffix(generateTestDBName("test_db_", "TestUsers/create_1_2"))
+		require.True(t, ok)
+		assert.Equal(t, os.Getpid(), pid)
+	})
+
+	t.Run("foreign names", func(t *testing.T) {
+		for _, name := range []string{"test_db_", "test_db_users", "test_db_1_x_3", "test_db_a_1_2", "postgres"} {
+			_, _, ok := parseDBNameSuffix(name)
+			assert.False(t, ok, name)
+		}
+	})
+}
+
+func TestStaleReason(t *testing.T) {
+	now := time.Now()
+	alive := func(pid int) bool { return pid == 1 }
+
+	fresh := SweptDatabase{Name: "fresh", CreatedAt: now.Add(-time.Minute), PID: 1}
+	old := SweptDatabase{Name: "old", CreatedAt: now.Add(-2 * time.Hour), PID: 1}
+	orphan := SweptDatabase{Name: "orphan", CreatedAt: now.Add(-time.Minute), PID: 2}
+
+	ageOnly := SweepOptions{MaxAge: time.Hour}
+	assert.Empty(t, staleReason(fresh, ageOnly, now, alive))
+	assert.Equal(t, "older than 1h0m0s", staleReason(old, ageOnly, now, alive))
+	assert.Empty(t, staleReason(orphan, ageOnly, now, alive))
+
+	processOnly := SweepOptions{CheckProcess: true}
+	assert.Empty(t, staleReason(old, processOnly, now, alive))
+	assert.Equal(t, "process 2 is not running", staleReason(orphan, processOnly, now, alive))
+}
+
+func TestIsCheckpoint(t *testing.T) {
+	assert.True(t, isCheckpoint("sql_sandbox: checkpoint seeded"))
+	assert.False(t, isCheckpoint(""))
+	assert.False(t, isCheckpoint("sql_sandbox: retained after failure of TestCheckpointRestore"))
+}
+
+func TestProcessAlive(t *testing.T) {
+	assert.True(t, processAlive(os.Getpid()))
+	assert.False(t, processAlive(0))
+	assert.False(t, processAlive(-1))
+}
+
+func TestSweep(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	adminURL := ReplaceDBName(getTestDBURL(), "postgres")
+	adminDB, err := sql.Open("postgres", adminURL)
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	// A database that looks like it was created by a long gone process a day ago
+	prefix := "test_sweep_"
+	orphanName := fmt.Sprintf("%s%d_%d_%d", prefix, time.Now().Add(-24*time.Hour).UnixNano(), 999999, 1)
+	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s"`, orphanName))
+	require.NoError(t, err)
+	defer dropTestDatabase(ctx, adminDB, orphanName)
+	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE ROLE "%s"`, orphanName))
+	require.NoError(t, err)
+	defer dropSandboxRole(ctx, adminDB, orphanName)
+
+	// A database owned by this process
+	liveName := generateUniqueDBName(prefix)
+	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s"`, liveName))
+	require.NoError(t, err)
+	defer dropTestDatabase(ctx, adminDB, liveName)
+
+	opts := SweepOptions{Prefix: prefix, MaxAge: time.Hour, CheckProcess: true, DryRun: true}
+	stale, err := Sweep(ctx, adminURL, opts)
+	require.NoError(t, err)
+	require.Len(t, stale, 1)
+	assert.Equal(t, orphanName, stale[0].Name)
+	assert.True(t, databaseExists(t, adminDB, orphanName))
+
+	opts.DryRun = false
+	swept, err := Sweep(ctx, adminURL, opts)
+	require.NoError(t, err)
+	require.Len(t, swept, 1)
+	assert.False(t, databaseExists(t, adminDB, orphanName))
+	assert.True(t, databaseExists(t, adminDB, liveName))
+
+	// The sandbox role of the swept database is dropped with it
+	var roleExists bool
+	require.NoError(t, adminDB.QueryRowContext(ctx, "SELECT EXISTS(SELECT FROM pg_roles WHERE rolname = $1)", orphanName).Scan(&roleExists))
+	assert.False(t, roleExists)
+}
+
+func TestSweepCheckpoints(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	adminURL := ReplaceDBName(getTestDBURL(), "postgres")
+	adminDB, err := sql.Open("postgres", adminURL)
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	// A checkpoint left behind by a long gone process
+	prefix := "test_sweep_ckpt_"
+	checkpointName := fmt.Sprintf("%s%sseeded_%d_%d_%d", prefix, checkpointNamePrefix, time.Now().Add(-24*time.Hour).UnixNano(), 999999, 1)
+	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s"`, checkpointName))
+	require.NoError(t, err)
+	defer dropTestDatabase(ctx, adminDB, checkpointName)
+	require.NoError(t, commentOnDatabase(ctx, adminDB, checkpointName, checkpointCommentPrefix+" seeded"))
+
+	swept, err := Sweep(ctx, adminURL, SweepOptions{Prefix: prefix, MaxAge: time.Hour})
+	require.NoError(t, err)
+	require.Len(t, swept, 1)
+	assert.Equal(t, checkpointName, swept[0].Name)
+	assert.True(t, swept[0].Checkpoint)
+	assert.False(t, databaseExists(t, adminDB, checkpointName))
+}
+
+func TestSweepWithoutCreateRole(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	adminURL := ReplaceDBName(getTestDBURL(), "postgres")
+	adminDB, err := sql.Open("postgres", adminURL)
+	require.NoError(t, err)
+	defer adminDB.Close()
+
+	// An admin role that may create databases but not roles
+	sweeper := fmt.Sprintf("sweeper_%d", os.Getpid())
+	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE ROLE "%s" LOGIN CREATEDB PASSWORD 'sweeper'`, sweeper))
+	require.NoError(t, err)
+	defer adminDB.ExecContext(ctx, fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, sweeper))
+
+	prefix := "test_sweep_norole_"
+	orphanName := fmt.Sprintf("%s%d_%d_%d", prefix, time.Now().Add(-24*time.Hour).UnixNano(), 999999, 1)
+	_, err = adminDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s" OWNER "%s"`, orphanName, sweeper))
+	require.NoError(t, err)
+	defer dropTestDatabase(ctx, adminDB, orphanName)
+
+	sweeperURL, err := withCredentials(adminURL, sweeper, "sweeper")
+	require.NoError(t, err)
+
+	// Databases without a sandbox role are swept without touching roles
+	swept, err := Sweep(ctx, sweeperURL, SweepOptions{Prefix: prefix, MaxAge: time.Hour})
+	require.NoError(t, err)
+	require.Len(t, swept, 1)
+	assert.False(t, databaseExists(t, adminDB, orphanName))
+}
+
+func databaseExists(t *testing.T, adminDB *sql.DB, name string) bool {
+	var exists bool
+	err := adminDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists)
+	require.NoError(t, err)
+	return exists
+}
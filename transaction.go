@@ -0,0 +1,301 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// newTxSandbox creates a sandbox whose connection is pinned to a single connection to the
+// shared database, inside a transaction that is rolled back on Close
+func (m *Manager) newTxSandbox(ctx context.Context) (*Sandbox, error) {
+	config := m.config
+	sharedDBName, err := m.ensureSharedDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := newConnector(config, ReplaceDBName(config.MainDBURL, sharedDBName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to shared database: %w", err)
+	}
+
+	tx := &txConnector{connector: connector}
+	testDBConn := sql.OpenDB(tx)
+
+	// Every statement must run on the single connection holding the transaction
+	testDBConn.SetMaxOpenConns(1)
+	testDBConn.SetMaxIdleConns(1)
+	testDBConn.SetConnMaxLifetime(0)
+
+	// Test shared database connection with context, this also opens the transaction
+	if err := testDBConn.PingContext(ctx); err != nil {
+		testDBConn.Close()
+		tx.rollback()
+		return nil, fmt.Errorf("failed to ping shared database: %w", err)
+	}
+
+	return &Sandbox{
+		TestDB: testDBConn,
+		DBName: sharedDBName,
+		Config: config,
+		tx:     tx,
+	}, nil
+}
+
+// ensureSharedDatabase creates the database shared by transaction sandboxes from the
+// template, once per template and prefix and under an advisory lock across processes.
+// The database is kept between runs since every sandbox rolls back its changes.
+func (m *Manager) ensureSharedDatabase(ctx context.Context) (string, error) {
+	adminDB, config := m.adminDB, m.config
+	sharedDBName := config.TestDBPrefix + "shared_" + config.TemplateDBName
+	if err := validateIdentifier("shared database name", sharedDBName); err != nil {
+		return "", err
+	}
+
+	stateAny, _ := m.sharedDBMap.LoadOrStore(sharedDBName, &setupState{})
+	state := stateAny.(*setupState)
+
+	state.once.Do(func() {
+		release, err := acquireAdvisoryLock(ctx, adminDB, "shared|"+sharedDBName)
+		if err != nil {
+			state.err = err
+			return
+		}
+		defer release()
+
+		// The shared database carries the comment of the template it was cloned from,
+		// so that it is rebuilt together with a stale template
+		templateComment, _, err := databaseComment(ctx, adminDB, config.TemplateDBName)
+		if err != nil {
+			state.err = fmt.Errorf("failed to read template comment: %w", err)
+			return
+		}
+		sharedComment, exists, err := databaseComment(ctx, adminDB, sharedDBName)
+		if err != nil {
+			state.err = fmt.Errorf("failed to check shared database: %w", err)
+			return
+		}
+		if exists && sharedComment == templateComment {
+			// The settings may have changed since the shared database was cloned
+			if err := applyDatabaseSettings(ctx, adminDB, sharedDBName, config.Settings); err != nil {
+				state.err = err
+			}
+			return
+		}
+		if exists {
+			log.Printf("Shared database '%s' was cloned from an outdated template, rebuilding", sharedDBName)
+			if err := m.limiter.dropDatabase(ctx, adminDB, sharedDBName); err != nil {
+				state.err = fmt.Errorf("failed to drop outdated shared database: %w", err)
+				return
+			}
+		}
+
+		if err := cloneDatabase(ctx, adminDB, m.limiter, config, sharedDBName); err != nil {
+			state.err = fmt.Errorf("failed to create shared database: %w", err)
+			return
+		}
+
+		if templateComment != "" {
+			if err := commentOnDatabase(ctx, adminDB, sharedDBName, templateComment); err != nil {
+				state.err = fmt.Errorf("failed to comment shared database: %w", err)
+			}
+		}
+	})
+
+	if state.err != nil {
+		return "", state.err
+	}
+
+	return sharedDBName, nil
+}
+
+// txConnector hands out a single connection that runs inside a transaction
+type txConnector struct {
+	connector driver.Connector
+
+	mu     sync.Mutex
+	conn   *txConn
+	closed bool
+}
+
+// Connect implements driver.Connector
+func (c *txConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, fmt.Errorf("sandbox is closed")
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	inner, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	beginner, ok := inner.(driver.ConnBeginTx)
+	if !ok {
+		inner.Close()
+		return nil, fmt.Errorf("driver does not support BeginTx")
+	}
+	outer, err := beginner.BeginTx(ctx, driver.TxOptions{})
+	if err != nil {
+		inner.Close()
+		return nil, fmt.Errorf("failed to begin sandbox transaction: %w", err)
+	}
+
+	c.conn = &txConn{inner: inner, outer: outer}
+	return c.conn, nil
+}
+
+// Driver implements driver.Connector
+func (c *txConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// rollback rolls back the sandbox transaction and closes the underlying connection
+func (c *txConnector) rollback() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+
+	var errs []error
+	if err := c.conn.outer.Rollback(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to roll back sandbox transaction: %w", err))
+	}
+	if err := c.conn.inner.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close sandbox connection: %w", err))
+	}
+	c.conn = nil
+
+	return errors.Join(errs...)
+}
+
+// txConn wraps a driver connection that is inside the sandbox transaction.
+// Transactions started on it are translated into savepoints.
+type txConn struct {
+	inner driver.Conn
+	outer driver.Tx
+	seq   int
+}
+
+// Prepare implements driver.Conn
+func (c *txConn) Prepare(query string) (driver.Stmt, error) {
+	return c.inner.Prepare(query)
+}
+
+// PrepareContext implements driver.ConnPrepareContext
+func (c *txConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.inner.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.inner.Prepare(query)
+}
+
+// Close implements driver.Conn. The underlying connection stays open until the
+// sandbox is closed, so that the transaction survives database/sql recycling it.
+func (c *txConn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn
+func (c *txConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx implements driver.ConnBeginTx by creating a savepoint. Isolation level and
+// read-only options cannot be changed inside the sandbox transaction and are ignored.
+func (c *txConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.seq++
+	name := fmt.Sprintf("sql_sandbox_sp_%d", c.seq)
+	if err := c.exec(ctx, "SAVEPOINT "+name); err != nil {
+		return nil, err
+	}
+	return &savepointTx{conn: c, name: name}, nil
+}
+
+// ExecContext implements driver.ExecerContext
+func (c *txConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.inner.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+// QueryContext implements driver.QueryerContext
+func (c *txConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.inner.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+// CheckNamedValue implements driver.NamedValueChecker
+func (c *txConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.inner.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// Ping implements driver.Pinger
+func (c *txConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.inner.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter
+func (c *txConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.inner.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator
+func (c *txConn) IsValid() bool {
+	if validator, ok := c.inner.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *txConn) exec(ctx context.Context, query string) error {
+	execer, ok := c.inner.(driver.ExecerContext)
+	if !ok {
+		return fmt.Errorf("driver does not support ExecContext")
+	}
+	_, err := execer.ExecContext(ctx, query, nil)
+	return err
+}
+
+// savepointTx is a transaction nested in the sandbox transaction
+type savepointTx struct {
+	conn *txConn
+	name string
+}
+
+// Commit implements driver.Tx by releasing the savepoint
+func (t *savepointTx) Commit() error {
+	return t.conn.exec(context.Background(), "RELEASE SAVEPOINT "+t.name)
+}
+
+// Rollback implements driver.Tx by rolling back to the savepoint
+func (t *savepointTx) Rollback() error {
+	return t.conn.exec(context.Background(), "ROLLBACK TO SAVEPOINT "+t.name)
+}
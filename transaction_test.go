@@ -0,0 +1,147 @@
+package sql_sandbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConn is a fake driver connection that records the executed statements
+type recordingConn struct {
+	statements *[]string
+	closed     bool
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c *recordingConn) Close() error                              { c.closed = true; return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	*c.statements = append(*c.statements, "BEGIN")
+	return recordingTx{c}, nil
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	*c.statements = append(*c.statements, query)
+	return driver.RowsAffected(1), nil
+}
+
+type recordingTx struct{ conn *recordingConn }
+
+func (t recordingTx) Commit() error {
+	*t.conn.statements = append(*t.conn.statements, "COMMIT")
+	return nil
+}
+
+func (t recordingTx) Rollback() error {
+	*t.conn.statements = append(*t.conn.statements, "ROLLBACK")
+	return nil
+}
+
+type recordingConnector struct {
+	conn     *recordingConn
+	connects int
+}
+
+func (c *recordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.connects++
+	return c.conn, nil
+}
+
+func (c *recordingConnector) Driver() driver.Driver { return nil }
+
+func TestTxConnectorSavepoints(t *testing.T) {
+	var statements []string
+	inner := &recordingConn{statements: &statements}
+	recorder := &recordingConnector{conn: inner}
+	connector := &txConnector{connector: recorder}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+
+	_, err := db.Exec("INSERT 1")
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT 2")
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	tx, err = db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, db.Close())
+	assert.False(t, inner.closed, "closing the pool must keep the transaction open")
+
+	require.NoError(t, connector.rollback())
+	assert.True(t, inner.closed)
+	assert.Equal(t, 1, recorder.connects)
+	assert.Equal(t, []string{
+		"BEGIN",
+		"INSERT 1",
+		"SAVEPOINT sql_sandbox_sp_1",
+		"INSERT 2",
+		"ROLLBACK TO SAVEPOINT sql_sandbox_sp_1",
+		"SAVEPOINT sql_sandbox_sp_2",
+		"RELEASE SAVEPOINT sql_sandbox_sp_2",
+		"ROLLBACK",
+	}, statements)
+
+	_, err = connector.Connect(context.Background())
+	require.Error(t, err)
+}
+
+func TestSandboxTransactionIsolation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+
+	config := &Config{
+		TemplateDBName:    "template_test",
+		TestDBPrefix:      "test_tx_",
+		MaxConnections:    5,
+		ConnectionTimeout: 10 * time.Second,
+		Isolation:         IsolationTransaction,
+	}
+
+	sandbox, err := New(getTestDBURL(), config)
+	require.NoError(t, err)
+
+	db := sandbox.DB()
+	_, err = db.Exec("CREATE TABLE tx_isolation (id INT PRIMARY KEY)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO tx_isolation VALUES (1)")
+	require.NoError(t, err)
+
+	// A failing nested transaction only rolls back to its savepoint
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO tx_isolation VALUES (1)")
+	require.Error(t, err)
+	require.NoError(t, tx.Rollback())
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM tx_isolation").Scan(&count))
+	assert.Equal(t, 1, count)
+
+	require.NoError(t, sandbox.Close())
+
+	// The next sandbox on the same shared database does not see the table
+	next, err := New(getTestDBURL(), config)
+	require.NoError(t, err)
+	defer next.Close()
+	assert.Equal(t, sandbox.DBName, next.DBName)
+
+	var exists bool
+	require.NoError(t, next.DB().QueryRow("SELECT to_regclass('tx_isolation') IS NOT NULL").Scan(&exists))
+	assert.False(t, exists)
+}